@@ -1,55 +1,59 @@
 package client
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/genvmoroz/simple-torrent-client/model"
 	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
 )
 
-const port = 6881
+const (
+	DefaultPort = 6881
 
-func GetTrackerInfo(torrentInfo model.TorrentInfo, peerID [20]byte) (model.TrackerInfo, error) {
-	announces := make([]string, 0)
-	for _, announceArray := range torrentInfo.AnnounceList {
-		for _, announce := range announceArray {
-			announces = append(announces, announce)
-		}
-	}
-	if len(announces) == 0 {
-		return model.TrackerInfo{}, errors.New("announces cannot be empty")
-	}
-
-	peers := make([]model.PeerInfo, 0)
+	httpTimeout = 30 * time.Second // the longest an HTTP tracker may take to answer, including reading the body
+)
 
-	trackerInfo, err := getTrackerInfo(torrentInfo.InfoHash, peerID, announces[0], torrentInfo.Length, port)
-	if err != nil {
-		return model.TrackerInfo{}, fmt.Errorf("with announce: %s, err: %w", announces[0], err)
-	}
+// Announce events, an empty event is a regular re-announce.
+const (
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventCompleted Event = "completed"
+	EventStopped   Event = "stopped"
+)
 
-	for _, peer := range trackerInfo.Peers {
-		peers = appendWithoutDuplicates(peers, peer)
+type (
+	Event string
+
+	// AnnounceParams are the values reported to the tracker on announce.
+	AnnounceParams struct {
+		InfoHash   [20]byte
+		PeerID     [20]byte
+		Port       uint16
+		Uploaded   int64
+		Downloaded int64
+		Left       int64
+		Event      Event
+		TrackerID  string // the tracker id the tracker sent in its previous response
 	}
+)
 
-	for i := 1; i < len(announces); i++ {
-		var ti model.TrackerInfo
-		ti, err = getTrackerInfo(torrentInfo.InfoHash, peerID, announces[0], torrentInfo.Length, port)
-		if err != nil {
-			return model.TrackerInfo{}, fmt.Errorf("with announce: %s, err: %w", announces[0], err)
-		}
-		for _, peer := range ti.Peers {
-			peers = appendWithoutDuplicates(peers, peer)
-		}
-	}
+var httpClient = &http.Client{Timeout: httpTimeout}
 
-	trackerInfo.Peers = peers
-	return trackerInfo, nil
+// GetTrackerInfo announces the whole torrent as left to the trackers of the torrent, see Trackers.Announce.
+func GetTrackerInfo(ctx context.Context, torrentInfo model.TorrentInfo, peerID [20]byte) (model.TrackerInfo, error) {
+	return NewTrackers(torrentInfo).Announce(ctx, AnnounceParams{
+		InfoHash: torrentInfo.InfoHash,
+		PeerID:   peerID,
+		Port:     DefaultPort,
+		Left:     torrentInfo.Length,
+	})
 }
 
 func appendWithoutDuplicates(peers []model.PeerInfo, peer model.PeerInfo) []model.PeerInfo {
@@ -67,20 +71,41 @@ func appendWithoutDuplicates(peers []model.PeerInfo, peer model.PeerInfo) []mode
 	return peers
 }
 
-func getTrackerInfo(infoHash, peerID [20]byte, announce string, length int64, port uint16) (model.TrackerInfo, error) {
-	trackerUrl, err := PrepareTrackerURL(infoHash, peerID, announce, length, port)
+// getTrackerInfo announces to the tracker, the transport is chosen by the scheme of the announce URL.
+func getTrackerInfo(ctx context.Context, announce string, params AnnounceParams) (model.TrackerInfo, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return model.TrackerInfo{}, fmt.Errorf("failed to parse announce: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return getHTTPTrackerInfo(ctx, announce, params)
+	case "udp":
+		return getUDPTrackerInfo(ctx, u.Host, params)
+	default:
+		return model.TrackerInfo{}, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+func getHTTPTrackerInfo(ctx context.Context, announce string, params AnnounceParams) (model.TrackerInfo, error) {
+	trackerUrl, err := PrepareTrackerURL(announce, params)
 	if err != nil {
 		return model.TrackerInfo{}, fmt.Errorf("failed to prepare TrackerURL: %w", err)
 	}
 
-	resp, err := http.Get(prepareGetRequestUrl(*trackerUrl))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerUrl.String(), nil)
+	if err != nil {
+		return model.TrackerInfo{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return model.TrackerInfo{}, fmt.Errorf("failed to do get request: %w", err)
 	}
 	defer func() {
 		if resp != nil {
 			if errClose := resp.Body.Close(); errClose != nil {
-				log.Printf("failed to close resp Body: %w", errClose)
+				log.Printf("failed to close resp Body: %s", errClose.Error())
 			}
 		}
 	}()
@@ -92,30 +117,31 @@ func getTrackerInfo(infoHash, peerID [20]byte, announce string, length int64, po
 	return bencode.ParseTrackerInfo(resp.Body)
 }
 
-func prepareGetRequestUrl(u url.URL) string {
-	return fmt.Sprintf(
-		`http://%s%s?%s`,
-		u.Host,
-		u.Path,
-		u.RawQuery,
-	)
-}
-
-func PrepareTrackerURL(infoHash, peerID [20]byte, announce string, length int64, port uint16) (*url.URL, error) {
+// PrepareTrackerURL adds the announce parameters to the query of the announce URL, keeping the parameters it already has.
+func PrepareTrackerURL(announce string, params AnnounceParams) (*url.URL, error) {
 	base, err := url.Parse(announce)
 	if err != nil {
 		return nil, err
 	}
-	params := url.Values{
-		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.FormatInt(length, 10)},
+	query, err := url.ParseQuery(base.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	query.Set("info_hash", string(params.InfoHash[:]))
+	query.Set("peer_id", string(params.PeerID[:]))
+	query.Set("port", strconv.Itoa(int(params.Port)))
+	query.Set("uploaded", strconv.FormatInt(params.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(params.Downloaded, 10))
+	query.Set("compact", "1")
+	query.Set("left", strconv.FormatInt(params.Left, 10))
+	if params.Event != EventNone {
+		query.Set("event", string(params.Event))
+	}
+	if params.TrackerID != "" {
+		query.Set("trackerid", params.TrackerID)
 	}
 
-	base.RawQuery = params.Encode()
+	base.RawQuery = query.Encode()
 	return base, nil
 }
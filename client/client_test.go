@@ -0,0 +1,74 @@
+package client
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareTrackerURL(t *testing.T) {
+	params := AnnounceParams{
+		InfoHash:   [20]byte{1},
+		PeerID:     [20]byte{2},
+		Port:       DefaultPort,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+	}
+	tests := []struct {
+		name     string
+		announce string
+		event    Event
+		id       string
+		want     url.Values
+	}{
+		{
+			name:     "regular",
+			announce: "http://tracker/announce",
+			want: url.Values{
+				"info_hash":  {string(params.InfoHash[:])},
+				"peer_id":    {string(params.PeerID[:])},
+				"port":       {"6881"},
+				"uploaded":   {"10"},
+				"downloaded": {"20"},
+				"left":       {"30"},
+				"compact":    {"1"},
+			},
+		},
+		{
+			name:     "event, tracker id and passkey",
+			announce: "http://tracker/announce?passkey=secret",
+			event:    EventStarted,
+			id:       "abc",
+			want: url.Values{
+				"info_hash":  {string(params.InfoHash[:])},
+				"peer_id":    {string(params.PeerID[:])},
+				"port":       {"6881"},
+				"uploaded":   {"10"},
+				"downloaded": {"20"},
+				"left":       {"30"},
+				"compact":    {"1"},
+				"event":      {"started"},
+				"trackerid":  {"abc"},
+				"passkey":    {"secret"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := params
+			p.Event = tt.event
+			p.TrackerID = tt.id
+			got, err := PrepareTrackerURL(tt.announce, p)
+			if err != nil {
+				t.Fatalf("PrepareTrackerURL() error = %v", err)
+			}
+			if got.Scheme != "http" || got.Host != "tracker" || got.Path != "/announce" {
+				t.Errorf("PrepareTrackerURL() got = %s", got)
+			}
+			if !reflect.DeepEqual(got.Query(), tt.want) {
+				t.Errorf("PrepareTrackerURL() query got = %v, want %v", got.Query(), tt.want)
+			}
+		})
+	}
+}
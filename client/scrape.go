@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+const httpMaxScrapeHashes = 64 // keeps the query of one scrape request to a few kilobytes
+
+// ErrScrapeNotSupported is returned for announce URLs that don't follow the scrape convention.
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// Scrape returns the state of the torrents on the tracker of the announce URL by info hash, without announcing.
+// Torrents the tracker doesn't report are left out. Many info hashes are split into several requests.
+func Scrape(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]model.ScrapeInfo, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("no info hashes to scrape")
+	}
+	scrapeURL, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := httpMaxScrapeHashes
+	if scrapeURL.Scheme == "udp" {
+		batch = udpMaxScrapeHashes
+	}
+
+	infos := make(map[[20]byte]model.ScrapeInfo, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += batch {
+		end := start + batch
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		if err = scrape(ctx, scrapeURL, infoHashes[start:end], infos); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// ScrapeURL derives the scrape URL from the announce URL, see http://bittorrent.org/beps/bep_0048.html
+// The last path segment of an HTTP announce URL must start with "announce", which is replaced with "scrape".
+// UDP trackers are scraped at the announce address.
+func ScrapeURL(announce string) (*url.URL, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse announce: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return u, nil
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, ErrScrapeNotSupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u, nil
+}
+
+// scrape scrapes the info hashes with a single request and adds the states to infos.
+func scrape(ctx context.Context, scrapeURL *url.URL, infoHashes [][20]byte, infos map[[20]byte]model.ScrapeInfo) error {
+	if scrapeURL.Scheme == "udp" {
+		udpInfos, err := udpScrape(ctx, scrapeURL.Host, infoHashes)
+		if err != nil {
+			return err
+		}
+		for i, info := range udpInfos {
+			infos[infoHashes[i]] = info
+		}
+		return nil
+	}
+
+	httpInfos, err := httpScrape(ctx, *scrapeURL, infoHashes)
+	if err != nil {
+		return err
+	}
+	for infoHash, info := range httpInfos {
+		infos[infoHash] = info
+	}
+	return nil
+}
+
+func httpScrape(ctx context.Context, scrapeURL url.URL, infoHashes [][20]byte) (map[[20]byte]model.ScrapeInfo, error) {
+	query, err := url.ParseQuery(scrapeURL.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", string(infoHash[:]))
+	}
+	scrapeURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do get request: %w", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			log.Printf("failed to close resp Body: %s", errClose.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	return bencode.ParseScrapeInfo(resp.Body)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		announce string
+		want     string
+		wantErr  error
+	}{
+		{name: "announce", announce: "http://example.com/announce", want: "http://example.com/scrape"},
+		{name: "nested", announce: "http://example.com/x/announce", want: "http://example.com/x/scrape"},
+		{name: "suffix", announce: "http://example.com/announce.php", want: "http://example.com/scrape.php"},
+		{name: "query", announce: "https://example.com/announce?passkey=abc", want: "https://example.com/scrape?passkey=abc"},
+		{name: "udp", announce: "udp://example.com:80", want: "udp://example.com:80"},
+		{name: "not last segment", announce: "http://example.com/announce/x", wantErr: ErrScrapeNotSupported},
+		{name: "other name", announce: "http://example.com/a", wantErr: ErrScrapeNotSupported},
+		{name: "no path", announce: "http://example.com", wantErr: ErrScrapeNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ScrapeURL(tt.announce)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ScrapeURL() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ScrapeURL() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrape(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		// only the first torrent is known to the tracker
+		if hashes := r.URL.Query()["info_hash"]; len(hashes) != 2 {
+			t.Errorf("scrape with %d info hashes, want 2", len(hashes))
+		}
+		_, _ = w.Write([]byte("d5:filesd20:\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00d8:completei5e10:downloadedi9e10:incompletei3eeee"))
+	}))
+	defer server.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	go serveUDPTracker(t, conn, make(chan struct{}, 10))
+
+	infoHashes := [][20]byte{{1}, {2}}
+	tests := []struct {
+		name     string
+		announce string
+		want     map[[20]byte]model.ScrapeInfo
+		wantErr  bool
+	}{
+		{
+			name:     "http",
+			announce: server.URL + "/announce",
+			want:     map[[20]byte]model.ScrapeInfo{{1}: {Complete: 5, Downloaded: 9, Incomplete: 3}},
+		},
+		{
+			name:     "udp",
+			announce: "udp://" + conn.LocalAddr().String(),
+			want:     map[[20]byte]model.ScrapeInfo{{1}: {Complete: 1}, {2}: {Complete: 2}},
+		},
+		{
+			name:     "http error",
+			announce: server.URL + "/x/announce",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Scrape(context.Background(), tt.announce, infoHashes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scrape() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Scrape() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
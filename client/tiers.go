@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+type (
+	// Trackers keeps the announce tiers of a torrent, see http://bittorrent.org/beps/bep_0012.html
+	Trackers struct {
+		mux        sync.Mutex
+		tiers      [][]string
+		trackerIDs map[string]string // tracker id per announce URL
+	}
+
+	// AnnounceError is the failure of a single tracker.
+	AnnounceError struct {
+		Announce string
+		Err      error
+	}
+
+	// AnnounceErrors collects the failures of every tracker that didn't answer.
+	AnnounceErrors []*AnnounceError
+)
+
+// ErrNoTrackerAnswered is returned by Announce when not a single tracker answered.
+var ErrNoTrackerAnswered = errors.New("no tracker answered")
+
+func (e *AnnounceError) Error() string {
+	return fmt.Sprintf("with announce: %s, err: %s", e.Announce, e.Err.Error())
+}
+
+func (e *AnnounceError) Unwrap() error {
+	return e.Err
+}
+
+func (e AnnounceErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// NewTrackers shuffles the trackers within every tier of the announce-list,
+// the top-level announce is used when there is no announce-list.
+func NewTrackers(torrentInfo model.TorrentInfo) *Trackers {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	tiers := make([][]string, 0, len(torrentInfo.AnnounceList))
+	for _, announceArray := range torrentInfo.AnnounceList {
+		tier := make([]string, 0, len(announceArray))
+		for _, announce := range announceArray {
+			if announce != "" {
+				tier = append(tier, announce)
+			}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		rnd.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		tiers = append(tiers, tier)
+	}
+	if len(tiers) == 0 && torrentInfo.Announce != "" {
+		tiers = append(tiers, []string{torrentInfo.Announce})
+	}
+
+	return &Trackers{
+		tiers:      tiers,
+		trackerIDs: make(map[string]string),
+	}
+}
+
+// Announce announces to every tier at once, see http://bittorrent.org/beps/bep_0012.html
+// The trackers of a tier are tried in order and the first one that answers is moved to the front of its tier,
+// every tracker gets an equal share of the time left to the tier, so a dead tracker can't use up the deadline.
+// The peers of all answered trackers are merged, the returned AnnounceErrors lists the trackers that failed,
+// the peers are returned even then. ErrNoTrackerAnswered is returned when every tracker failed.
+// The tracker id sent by a tracker is echoed back to it on the following announces.
+func (t *Trackers) Announce(ctx context.Context, params AnnounceParams) (model.TrackerInfo, error) {
+	tiers := t.snapshot()
+	if len(tiers) == 0 {
+		return model.TrackerInfo{}, fmt.Errorf("%w: announces cannot be empty", ErrNoTrackerAnswered)
+	}
+
+	type tierResult struct {
+		trackerInfo model.TrackerInfo
+		answered    bool
+		errs        AnnounceErrors
+	}
+
+	results := make([]tierResult, len(tiers))
+	wg := sync.WaitGroup{}
+	for index, tier := range tiers {
+		wg.Add(1)
+		go func(index int, tier []string) {
+			defer wg.Done()
+
+			res := &results[index]
+			for i, announce := range tier {
+				trackerParams := params
+				trackerParams.TrackerID = t.trackerID(announce)
+				trackerInfo, err := announceWithShare(ctx, announce, trackerParams, len(tier)-i)
+				if err != nil {
+					res.errs = append(res.errs, &AnnounceError{Announce: announce, Err: err})
+					continue
+				}
+				if trackerInfo.WarningMessage != "" {
+					log.Printf("tracker warning, announce: %s, message: %s", announce, trackerInfo.WarningMessage)
+				}
+				t.promote(index, announce, trackerInfo.TrackerID)
+				res.trackerInfo = trackerInfo
+				res.answered = true
+				return
+			}
+		}(index, tier)
+	}
+	wg.Wait()
+
+	merged := model.TrackerInfo{Peers: make([]model.PeerInfo, 0)}
+	var errs AnnounceErrors
+	var answered bool
+	for _, res := range results {
+		errs = append(errs, res.errs...)
+		if !res.answered {
+			continue
+		}
+		if !answered {
+			merged.Interval = res.trackerInfo.Interval
+			merged.MinInterval = res.trackerInfo.MinInterval
+			merged.WarningMessage = res.trackerInfo.WarningMessage
+			answered = true
+		}
+		if res.trackerInfo.Complete > merged.Complete {
+			merged.Complete = res.trackerInfo.Complete
+		}
+		if res.trackerInfo.Incomplete > merged.Incomplete {
+			merged.Incomplete = res.trackerInfo.Incomplete
+		}
+		for _, peer := range res.trackerInfo.Peers {
+			merged.Peers = appendWithoutDuplicates(merged.Peers, peer)
+		}
+	}
+
+	if !answered {
+		return model.TrackerInfo{}, fmt.Errorf("%w: %s", ErrNoTrackerAnswered, errs.Error())
+	}
+	if len(errs) > 0 {
+		return merged, errs
+	}
+	return merged, nil
+}
+
+// announceWithShare announces to the tracker within its share of the deadline, left is the number of trackers
+// of the tier that are still to try, this one included.
+func announceWithShare(ctx context.Context, announce string, params AnnounceParams, left int) (model.TrackerInfo, error) {
+	if deadline, ok := ctx.Deadline(); ok && left > 1 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(left))
+		defer cancel()
+	}
+	return getTrackerInfo(ctx, announce, params)
+}
+
+func (t *Trackers) snapshot() [][]string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+func (t *Trackers) trackerID(announce string) string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.trackerIDs[announce]
+}
+
+// promote moves the tracker that answered to the front of its tier and remembers its tracker id.
+func (t *Trackers) promote(tierIndex int, announce, trackerID string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if trackerID != "" {
+		t.trackerIDs[announce] = trackerID
+	}
+
+	tier := t.tiers[tierIndex]
+	for i, a := range tier {
+		if a == announce {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = announce
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func TestNewTrackers(t *testing.T) {
+	tests := []struct {
+		name        string
+		torrentInfo model.TorrentInfo
+		want        [][]string
+	}{
+		{
+			name:        "announce only",
+			torrentInfo: model.TorrentInfo{Announce: "udp://a"},
+			want:        [][]string{{"udp://a"}},
+		},
+		{
+			name: "announce-list wins over announce",
+			torrentInfo: model.TorrentInfo{
+				Announce:     "udp://a",
+				AnnounceList: [][]string{{"udp://b"}, {}, {"", "udp://c"}},
+			},
+			want: [][]string{{"udp://b"}, {"udp://c"}},
+		},
+		{
+			name: "nothing to announce to",
+			want: [][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewTrackers(tt.torrentInfo).snapshot(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewTrackers() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackersPromote(t *testing.T) {
+	trackers := &Trackers{
+		tiers:      [][]string{{"udp://a", "udp://b", "udp://c"}},
+		trackerIDs: make(map[string]string),
+	}
+	trackers.promote(0, "udp://c", "id")
+
+	want := [][]string{{"udp://c", "udp://a", "udp://b"}}
+	if got := trackers.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("promote() got = %v, want %v", got, want)
+	}
+	if got := trackers.trackerID("udp://c"); got != "id" {
+		t.Errorf("trackerID() got = %s, want id", got)
+	}
+}
+
+func TestTrackersAnnounce(t *testing.T) {
+	var mux sync.Mutex
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		hits[r.URL.Path]++
+		mux.Unlock()
+		switch r.URL.Path {
+		case "/down/announce":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		case "/hang/announce":
+			<-r.Context().Done()
+		case "/up/announce":
+			_, _ = w.Write([]byte("d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"))
+		default:
+			_, _ = w.Write([]byte("d8:intervali600e5:peers12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe1e"))
+		}
+	}))
+	defer server.Close()
+
+	down, hang := server.URL+"/down/announce", server.URL+"/hang/announce"
+	up, next := server.URL+"/up/announce", server.URL+"/next/announce"
+	trackers := &Trackers{
+		tiers:      [][]string{{down, up}, {hang, next}},
+		trackerIDs: make(map[string]string),
+	}
+
+	// the hanging tracker gets half of the deadline, so the tracker after it is asked in time
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, err := trackers.Announce(ctx, AnnounceParams{})
+	var errs AnnounceErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Errorf("Announce() error = %v, want the failures of %s and %s", err, down, hang)
+	}
+
+	// the peers of both answered trackers are merged without duplicates
+	want := []model.PeerInfo{
+		{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+		{IP: net.IP{10, 0, 0, 2}, Port: 6881},
+	}
+	if got.Interval != 900 || !reflect.DeepEqual(got.Peers, want) {
+		t.Errorf("Announce() got = %+v, want interval 900 and peers %v", got, want)
+	}
+
+	// the trackers that answered are tried first next time
+	wantTiers := [][]string{{up, down}, {next, hang}}
+	if got := trackers.snapshot(); !reflect.DeepEqual(got, wantTiers) {
+		t.Errorf("Announce() tiers got = %v, want %v", got, wantTiers)
+	}
+	if _, err = trackers.Announce(context.Background(), AnnounceParams{}); err != nil {
+		t.Errorf("Announce() error = %v", err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if hits["/down/announce"] != 1 || hits["/hang/announce"] != 1 {
+		t.Errorf("Announce() asked %v, want the failed trackers once", hits)
+	}
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// UDP tracker protocol, see http://bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDTTL = time.Minute
+	udpBaseTimeout     = 15 * time.Second
+	udpMaxRetries      = 8
+	udpMaxPacketSize   = 65507
+	udpMaxScrapeHashes = 74 // the most info hashes that fit into one scrape request
+)
+
+type (
+	udpTrackerClient struct {
+		mux         sync.Mutex
+		connections map[string]udpConnectionID
+	}
+
+	udpConnectionID struct {
+		id       uint64
+		obtained time.Time
+	}
+)
+
+var (
+	udpTrackers = &udpTrackerClient{connections: make(map[string]udpConnectionID)}
+
+	udpKey = randomUint32()
+
+	udpEvents = map[Event]uint32{
+		EventNone:      0,
+		EventCompleted: 1,
+		EventStarted:   2,
+		EventStopped:   3,
+	}
+)
+
+func getUDPTrackerInfo(ctx context.Context, host string, params AnnounceParams) (model.TrackerInfo, error) {
+	conn, ipLen, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return model.TrackerInfo{}, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	resp, err := udpTrackers.roundTrip(ctx, conn, host, udpActionAnnounce, func(connectionID uint64, txID uint32) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connectionID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		copy(req[16:36], params.InfoHash[:])
+		copy(req[36:56], params.PeerID[:])
+		binary.BigEndian.PutUint64(req[56:64], uint64(params.Downloaded))
+		binary.BigEndian.PutUint64(req[64:72], uint64(params.Left))
+		binary.BigEndian.PutUint64(req[72:80], uint64(params.Uploaded))
+		binary.BigEndian.PutUint32(req[80:84], udpEvents[params.Event])
+		binary.BigEndian.PutUint32(req[84:88], 0)          // IP address: default
+		binary.BigEndian.PutUint32(req[88:92], udpKey)     // key
+		binary.BigEndian.PutUint32(req[92:96], 0xffffffff) // num_want: default
+		binary.BigEndian.PutUint16(req[96:98], params.Port)
+		return req
+	})
+	if err != nil {
+		return model.TrackerInfo{}, err
+	}
+	if len(resp) < 20 {
+		return model.TrackerInfo{}, fmt.Errorf("announce response is too short, length %d", len(resp))
+	}
+
+	peers, err := bencode.ParseCompactPeers(resp[20:], ipLen)
+	if err != nil {
+		return model.TrackerInfo{}, fmt.Errorf("failed to parse Peers: %w", err)
+	}
+
+	return model.TrackerInfo{
+		Interval:   int64(binary.BigEndian.Uint32(resp[8:12])),
+		Incomplete: int64(binary.BigEndian.Uint32(resp[12:16])),
+		Complete:   int64(binary.BigEndian.Uint32(resp[16:20])),
+		Peers:      peers,
+	}, nil
+}
+
+func udpScrape(ctx context.Context, host string, infoHashes [][20]byte) ([]model.ScrapeInfo, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > udpMaxScrapeHashes {
+		return nil, fmt.Errorf("from 1 to %d info hashes can be scraped at once, got %d", udpMaxScrapeHashes, len(infoHashes))
+	}
+
+	conn, _, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	resp, err := udpTrackers.roundTrip(ctx, conn, host, udpActionScrape, func(connectionID uint64, txID uint32) []byte {
+		req := make([]byte, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connectionID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		for i, infoHash := range infoHashes {
+			copy(req[16+20*i:], infoHash[:])
+		}
+		return req
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response is too short, length %d", len(resp))
+	}
+
+	infos := make([]model.ScrapeInfo, len(infoHashes))
+	for i := range infos {
+		offset := 8 + 12*i
+		infos[i] = model.ScrapeInfo{
+			Complete:   int64(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Downloaded: int64(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Incomplete: int64(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+	return infos, nil
+}
+
+// dialUDPTracker connects to the tracker and returns the length of IPs in its peer lists, which depends on the address family.
+func dialUDPTracker(ctx context.Context, host string) (*net.UDPConn, int, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to dial %s: %w", host, err)
+	}
+	udpConn := conn.(*net.UDPConn)
+
+	ipLen := net.IPv6len
+	if udpConn.RemoteAddr().(*net.UDPAddr).IP.To4() != nil {
+		ipLen = net.IPv4len
+	}
+	return udpConn, ipLen, nil
+}
+
+// roundTrip sends the request built by newRequest and waits for the response,
+// retransmitting it after 15 * 2 ^ n seconds and renewing the connection ID once it expires.
+// It gives up once the context is done.
+func (c *udpTrackerClient) roundTrip(ctx context.Context, conn *net.UDPConn, host string, action uint32, newRequest func(connectionID uint64, txID uint32) []byte) ([]byte, error) {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	for n := 0; n <= udpMaxRetries; n++ {
+		connectionID, err := c.connectionID(ctx, conn, host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+
+		txID := randomUint32()
+		resp, err := exchange(conn, newRequest(connectionID, txID), txID, action, udpBaseTimeout<<n)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isTimeout(err) {
+			continue
+		}
+		return resp, err
+	}
+
+	return nil, fmt.Errorf("tracker %s did not respond", host)
+}
+
+// connectionID returns the cached connection ID or obtains a new one.
+func (c *udpTrackerClient) connectionID(ctx context.Context, conn *net.UDPConn, host string) (uint64, error) {
+	c.mux.Lock()
+	cached, ok := c.connections[host]
+	c.mux.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnectionIDTTL {
+		return cached.id, nil
+	}
+
+	for n := 0; n <= udpMaxRetries; n++ {
+		txID := randomUint32()
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+
+		resp, err := exchange(conn, req, txID, udpActionConnect, udpBaseTimeout<<n)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(resp) < 16 {
+			return 0, fmt.Errorf("connect response is too short, length %d", len(resp))
+		}
+
+		id := binary.BigEndian.Uint64(resp[8:16])
+		c.mux.Lock()
+		c.connections[host] = udpConnectionID{id: id, obtained: time.Now()}
+		c.mux.Unlock()
+		return id, nil
+	}
+
+	return 0, fmt.Errorf("tracker %s did not respond", host)
+}
+
+// exchange writes the request and reads packets until the response with the same transaction ID arrives or the timeout expires.
+func exchange(conn *net.UDPConn, req []byte, txID, action uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to write request: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		if len(resp) < 8 || binary.BigEndian.Uint32(resp[4:8]) != txID {
+			continue // stale or foreign packet
+		}
+
+		switch respAction := binary.BigEndian.Uint32(resp[0:4]); respAction {
+		case action:
+			return append([]byte(nil), resp...), nil
+		case udpActionError:
+			return nil, &model.TrackerFailure{Reason: string(bytes.TrimRight(resp[8:], "\x00"))}
+		default:
+			return nil, fmt.Errorf("unexpected action %d in response, expected %d", respAction, action)
+		}
+	}
+}
+
+// closeOnDone closes the connection once the context is done, so a blocked read returns.
+// The returned func stops watching the context.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func randomUint32() uint32 {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(buf)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+// serveUDPTracker answers connect and announce requests with a single peer and counts the connect requests.
+// Scraped torrents have as many seeders as the first byte of their info hash.
+func serveUDPTracker(t *testing.T, conn *net.UDPConn, connects chan<- struct{}) {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:12])
+		txID := req[12:16]
+
+		var resp []byte
+		switch action {
+		case udpActionConnect:
+			connects <- struct{}{}
+			resp = make([]byte, 16)
+			copy(resp[4:8], txID)
+			binary.BigEndian.PutUint64(resp[8:16], 42)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(req[0:8]) != 42 {
+				t.Errorf("announce with connection ID %d, want 42", binary.BigEndian.Uint64(req[0:8]))
+			}
+			resp = make([]byte, 26)
+			binary.BigEndian.PutUint32(resp[0:4], udpActionAnnounce)
+			copy(resp[4:8], txID)
+			binary.BigEndian.PutUint32(resp[8:12], 1800)
+			copy(resp[20:24], net.IPv4(10, 0, 0, 1).To4())
+			binary.BigEndian.PutUint16(resp[24:26], 6881)
+		case udpActionScrape:
+			hashes := (len(req) - 16) / 20
+			resp = make([]byte, 8+12*hashes)
+			binary.BigEndian.PutUint32(resp[0:4], udpActionScrape)
+			copy(resp[4:8], txID)
+			for i := 0; i < hashes; i++ {
+				binary.BigEndian.PutUint32(resp[8+12*i:], uint32(req[16+20*i]))
+			}
+		}
+		if _, err = conn.WriteToUDP(resp, addr); err != nil {
+			return
+		}
+	}
+}
+
+func TestGetUDPTrackerInfo(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	connects := make(chan struct{}, 10)
+	go serveUDPTracker(t, conn, connects)
+
+	want := model.TrackerInfo{
+		Interval: 1800,
+		Peers:    []model.PeerInfo{{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := getUDPTrackerInfo(context.Background(), conn.LocalAddr().String(), AnnounceParams{Port: DefaultPort})
+		if err != nil {
+			t.Fatalf("getUDPTrackerInfo() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("getUDPTrackerInfo() got = %v, want %v", got, want)
+		}
+	}
+
+	if len(connects) != 1 {
+		t.Errorf("connection ID was requested %d times, want 1", len(connects))
+	}
+}
+
+func TestUDPTrackerContextDeadline(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the tracker never answers, the announce gives up at the deadline instead of retrying for minutes
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = getUDPTrackerInfo(ctx, conn.LocalAddr().String(), AnnounceParams{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getUDPTrackerInfo() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("getUDPTrackerInfo() took %s", elapsed)
+	}
+}
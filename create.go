@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/genvmoroz/simple-torrent-client/metainfo"
+)
+
+const createdBy = "simple-torrent-client"
+
+// tiersFlag collects the trackers, every flag is a tier of comma-separated announce URLs.
+type tiersFlag [][]string
+
+func (f *tiersFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *tiersFlag) Set(value string) error {
+	*f = append(*f, strings.Split(value, ","))
+	return nil
+}
+
+// create builds a torrent of a file or directory: create [flags] <path>
+func create(args []string) error {
+	var trackers tiersFlag
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	flags.Var(&trackers, "a", "tier of comma-separated announce URLs, may be repeated")
+	output := flags.String("o", "", "output file, <name>.torrent by default")
+	name := flags.String("n", "", "name of the torrent, the base name of the path by default")
+	pieceLength := flags.Int64("l", 0, "piece length in bytes, chosen from the total length by default")
+	comment := flags.String("c", "", "comment")
+	private := flags.Bool("p", false, "private torrent, peers come from the trackers only")
+	source := flags.String("s", "", "source, e.g. the name of the private tracker")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "usage: create [flags] <path>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a single path, got %d", flags.NArg())
+	}
+
+	cfg := metainfo.Config{
+		Path:        flags.Arg(0),
+		Name:        *name,
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   createdBy,
+		Private:     *private,
+		Source:      *source,
+	}
+	// a single tracker doesn't need the announce list
+	if len(trackers) == 1 && len(trackers[0]) == 1 {
+		cfg.Announce = trackers[0][0]
+	} else {
+		cfg.AnnounceList = trackers
+	}
+
+	path := *output
+	if path == "" {
+		base := cfg.Name
+		if base == "" {
+			abs, err := filepath.Abs(cfg.Path)
+			if err != nil {
+				return fmt.Errorf("failed to resolve %s: %w", cfg.Path, err)
+			}
+			base = filepath.Base(abs)
+		}
+		path = base + ".torrent"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	torrentInfo, err := metainfo.Create(ctx, cfg, file)
+	if errClose := file.Close(); err == nil && errClose != nil {
+		err = fmt.Errorf("failed to close %s: %w", path, errClose)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+
+	log.Printf("created %s, info hash: %x, pieces: %d of %d bytes", path, torrentInfo.InfoHash, len(torrentInfo.PieceHashes), torrentInfo.PieceLength)
+	return nil
+}
@@ -0,0 +1,361 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAddr         = ":6881"
+	defaultQueryTimeout = 5 * time.Second
+	maintenanceInterval = 5 * time.Minute // tokens are rotated, the table is refreshed and saved on this interval
+	maxPacketSize       = 65535
+	maxReadBackoff      = time.Second // the longest wait after a failed read
+)
+
+// DefaultBootstrapNodes are well-known nodes used to join the DHT when no nodes are known.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var errClosed = errors.New("dht is closed")
+
+type (
+	// Config configures the DHT node, zero fields take their defaults.
+	Config struct {
+		Addr           string        // UDP address to listen on, :6881 by default
+		BootstrapNodes []string      // host:port of nodes used to join the DHT, DefaultBootstrapNodes by default
+		StatePath      string        // the node ID and routing table are kept in the file across restarts, empty disables it
+		QueryTimeout   time.Duration // how long a node is waited for, 5s by default
+	}
+
+	// DHT is a node of the mainline DHT, see http://bittorrent.org/beps/bep_0005.html
+	DHT struct {
+		config Config
+		conn   *net.UDPConn
+		table  *routingTable
+		tokens *tokens
+		peers  *peerStore
+		saved  []node // the nodes from the state file, they are pinged on bootstrap
+
+		mux     sync.Mutex
+		pending map[string]chan krpcMessage // transaction ID and address of the queried node to the response
+		txID    uint16
+
+		quit chan struct{}
+		wg   sync.WaitGroup
+	}
+)
+
+// New starts a DHT node that listens on config.Addr and joins the DHT in the background.
+func New(config Config) (*DHT, error) {
+	if config.Addr == "" {
+		config.Addr = defaultAddr
+	}
+	if config.BootstrapNodes == nil {
+		config.BootstrapNodes = DefaultBootstrapNodes
+	}
+	if config.QueryTimeout <= 0 {
+		config.QueryTimeout = defaultQueryTimeout
+	}
+
+	var saved state
+	if config.StatePath != "" {
+		var err error
+		saved, err = loadState(config.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to load dht state, path: %s, err: %s", config.StatePath, err.Error())
+		}
+	}
+	self, err := parseStateID(saved.ID)
+	if err != nil {
+		if self, err = RandomNodeID(); err != nil {
+			return nil, err
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", config.Addr, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", config.Addr, err)
+	}
+
+	d := &DHT{
+		config:  config,
+		conn:    conn,
+		table:   newRoutingTable(self),
+		tokens:  newTokens(),
+		peers:   newPeerStore(),
+		saved:   stateNodes(saved),
+		pending: make(map[string]chan krpcMessage),
+		quit:    make(chan struct{}),
+	}
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.readLoop()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.maintain()
+	}()
+
+	return d, nil
+}
+
+// ID returns the ID of the node.
+func (d *DHT) ID() NodeID {
+	return d.table.self
+}
+
+// Addr returns the address the node listens on.
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// AddNode pings the node at the address and adds it to the routing table if it answers.
+func (d *DHT) AddNode(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", address, err)
+	}
+	_, err = d.query(context.Background(), addr, methodPing, krpcArgs{})
+	return err
+}
+
+// Close stops the node and saves its state.
+func (d *DHT) Close() error {
+	close(d.quit)
+	err := d.conn.Close()
+	d.wg.Wait()
+
+	d.save()
+	return err
+}
+
+func (d *DHT) save() {
+	if d.config.StatePath == "" {
+		return
+	}
+	if err := saveState(d.config.StatePath, newState(d.table.self, d.table.nodes())); err != nil {
+		log.Printf("failed to save dht state, path: %s, err: %s", d.config.StatePath, err.Error())
+	}
+}
+
+// maintain bootstraps the node and keeps the routing table fresh until the node is closed.
+func (d *DHT) maintain() {
+	d.bootstrap()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+
+		d.tokens.rotate()
+		d.peers.expire()
+		if d.table.size() < k {
+			d.bootstrap()
+		} else if target, err := RandomNodeID(); err == nil {
+			d.lookup(context.Background(), target, methodFindNode) // refreshes the buckets on the way
+		}
+		d.save()
+	}
+}
+
+// bootstrap pings the saved and the bootstrap nodes, then looks up its own ID to fill the buckets near itself.
+func (d *DHT) bootstrap() {
+	addrs := make([]*net.UDPAddr, 0, len(d.saved)+len(d.config.BootstrapNodes))
+	for _, n := range d.saved {
+		addrs = append(addrs, n.addr)
+	}
+	for _, address := range d.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			log.Printf("failed to resolve dht bootstrap node: %s, err: %s", address, err.Error())
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			_, _ = d.query(context.Background(), addr, methodPing, krpcArgs{})
+		}(addr)
+	}
+	wg.Wait()
+
+	d.lookup(context.Background(), d.table.self, methodFindNode)
+}
+
+// readLoop handles the packets until the node is closed, it backs off while reading fails.
+func (d *DHT) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	var backoff time.Duration
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > maxReadBackoff {
+				backoff = maxReadBackoff
+			}
+			log.Printf("failed to read dht packet, retrying in %s, err: %s", backoff, err.Error())
+			select {
+			case <-time.After(backoff):
+				continue
+			case <-d.quit:
+				return
+			}
+		}
+		backoff = 0
+
+		msg, err := parseKRPC(buf[:n])
+		if err != nil {
+			continue // garbage is common on the DHT
+		}
+		switch msg.kind {
+		case krpcQuery:
+			d.handleQuery(msg, addr)
+		default:
+			d.deliver(msg, addr)
+		}
+	}
+}
+
+// query sends the query and waits for the response, errors returned by the node are *KRPCError.
+// The responding node is added to the routing table.
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args krpcArgs) (krpcMessage, error) {
+	args.id = d.table.self
+
+	d.mux.Lock()
+	d.txID++
+	txID := string([]byte{byte(d.txID >> 8), byte(d.txID)})
+	key := txID + addr.String()
+	ch := make(chan krpcMessage, 1)
+	d.pending[key] = ch
+	d.mux.Unlock()
+	defer func() {
+		d.mux.Lock()
+		delete(d.pending, key)
+		d.mux.Unlock()
+	}()
+
+	if err := d.send(krpcMessage{transactionID: txID, kind: krpcQuery, method: method, args: args}, addr); err != nil {
+		return krpcMessage{}, err
+	}
+
+	timer := time.NewTimer(d.config.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		if resp.kind == krpcError {
+			return krpcMessage{}, &KRPCError{Code: resp.errCode, Message: resp.errMessage}
+		}
+		d.table.seen(resp.values.id, addr)
+		return resp, nil
+	case <-timer.C:
+		return krpcMessage{}, fmt.Errorf("%s didn't answer %s in time", addr, method)
+	case <-ctx.Done():
+		return krpcMessage{}, ctx.Err()
+	case <-d.quit:
+		return krpcMessage{}, errClosed
+	}
+}
+
+// deliver passes the response to the query waiting for it, unexpected responses are dropped.
+func (d *DHT) deliver(msg krpcMessage, addr *net.UDPAddr) {
+	d.mux.Lock()
+	ch, ok := d.pending[msg.transactionID+addr.String()]
+	d.mux.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- msg:
+	default: // a duplicate response
+	}
+}
+
+func (d *DHT) handleQuery(msg krpcMessage, addr *net.UDPAddr) {
+	resp := krpcMessage{
+		transactionID: msg.transactionID,
+		kind:          krpcResponse,
+		values:        krpcValues{id: d.table.self},
+	}
+
+	switch msg.method {
+	case methodPing:
+	case methodFindNode:
+		resp.values.nodes = d.table.closest(msg.args.target, k)
+	case methodGetPeers:
+		resp.values.token = d.tokens.token(addr.IP)
+		if values := d.peers.get(msg.args.infoHash); len(values) > 0 {
+			resp.values.values = values
+		} else {
+			resp.values.nodes = d.table.closest(msg.args.infoHash, k)
+		}
+	case methodAnnouncePeer:
+		if !d.tokens.valid(msg.args.token, addr.IP) {
+			resp = errorMessage(msg.transactionID, errorProtocol, "bad token")
+			break
+		}
+		port := msg.args.port
+		if msg.args.impliedPort {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			resp = errorMessage(msg.transactionID, errorProtocol, "bad port")
+			break
+		}
+		if peer, ok := compactAddr(&net.UDPAddr{IP: addr.IP, Port: port}); ok {
+			d.peers.add(msg.args.infoHash, peer)
+		}
+	default:
+		resp = errorMessage(msg.transactionID, errorMethodUnknown, "method unknown")
+	}
+
+	if err := d.send(resp, addr); err != nil {
+		log.Printf("failed to answer dht query, method: %s, addr: %s, err: %s", msg.method, addr, err.Error())
+		return
+	}
+	// the node answers queries too, so it is likely alive
+	d.table.seen(msg.args.id, addr)
+}
+
+func (d *DHT) send(msg krpcMessage, addr *net.UDPAddr) error {
+	data, err := msg.encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", msg.kind, err)
+	}
+	if _, err = d.conn.WriteToUDP(data, addr); err != nil {
+		return fmt.Errorf("failed to send to %s: %w", addr, err)
+	}
+	return nil
+}
+
+func errorMessage(txID string, code int64, message string) krpcMessage {
+	return krpcMessage{transactionID: txID, kind: krpcError, errCode: code, errMessage: message}
+}
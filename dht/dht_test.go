@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func newTestDHT(t *testing.T, statePath string) *DHT {
+	d, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{},
+		StatePath:      statePath,
+		QueryTimeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return d
+}
+
+func TestKRPCRoundTrip(t *testing.T) {
+	msg := krpcMessage{
+		transactionID: "aa",
+		kind:          krpcResponse,
+		values: krpcValues{
+			id:     NodeID{1},
+			nodes:  []node{{id: NodeID{2}, addr: &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 6881}}},
+			values: []string{"\x0a\x00\x00\x02\x1a\xe1"},
+			token:  "token",
+		},
+	}
+	data, err := msg.encode()
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+	got, err := parseKRPC(data)
+	if err != nil {
+		t.Fatalf("parseKRPC() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("parseKRPC() got = %+v, want %+v", got, msg)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	router := newTestDHT(t, "")
+	defer func() { _ = router.Close() }()
+	announcer := newTestDHT(t, "")
+	defer func() { _ = announcer.Close() }()
+	seeker := newTestDHT(t, "")
+	defer func() { _ = seeker.Close() }()
+
+	for _, d := range []*DHT{announcer, seeker} {
+		if err := d.AddNode(router.Addr().String()); err != nil {
+			t.Fatalf("AddNode() error = %v", err)
+		}
+	}
+
+	infoHash := [20]byte{0xaa}
+	if _, err := announcer.Announce(context.Background(), infoHash, 6881); err != nil {
+		t.Fatalf("Announce() error = %v", err)
+	}
+
+	got, err := seeker.GetPeers(context.Background(), infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers() error = %v", err)
+	}
+	want := []model.PeerInfo{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPeers() got = %v, want %v", got, want)
+	}
+}
+
+func TestGetPeersCanceled(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}, QueryTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = d.Close() }()
+
+	// a node that never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer func() { _ = silent.Close() }()
+	d.table.seen(NodeID{1}, silent.LocalAddr().(*net.UDPAddr))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = d.GetPeers(ctx, [20]byte{0xaa}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetPeers() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetPeers() took %s, want it to end with the context", elapsed)
+	}
+}
+
+func TestStatePersisted(t *testing.T) {
+	router := newTestDHT(t, "")
+	defer func() { _ = router.Close() }()
+
+	path := filepath.Join(t.TempDir(), "dht.json")
+	d := newTestDHT(t, path)
+	if err := d.AddNode(router.Addr().String()); err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	id := d.ID()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	restored := newTestDHT(t, path)
+	defer func() { _ = restored.Close() }()
+	if restored.ID() != id {
+		t.Errorf("ID() got = %v, want %v", restored.ID(), id)
+	}
+	if len(restored.saved) != 1 || restored.saved[0].id != router.ID() {
+		t.Errorf("saved nodes got = %v, want the router", restored.saved)
+	}
+}
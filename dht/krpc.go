@@ -0,0 +1,219 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// KRPC message types and methods, see http://bittorrent.org/beps/bep_0005.html
+const (
+	krpcQuery    = "q"
+	krpcResponse = "r"
+	krpcError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+)
+
+type (
+	// krpcMessage is a query, a response or an error, only the fields of its type are set.
+	krpcMessage struct {
+		transactionID string
+		kind          string
+
+		method string
+		args   krpcArgs
+
+		values krpcValues
+
+		errCode    int64
+		errMessage string
+	}
+
+	// krpcArgs are the arguments of a query.
+	krpcArgs struct {
+		id          NodeID
+		target      NodeID // find_node
+		infoHash    NodeID // get_peers, announce_peer
+		token       string // announce_peer
+		port        int    // announce_peer
+		impliedPort bool   // announce_peer, the source port of the packet is used instead of port
+	}
+
+	// krpcValues are the return values of a response.
+	krpcValues struct {
+		id     NodeID
+		nodes  []node
+		values []string // compact peer infos
+		token  string
+	}
+
+	// KRPCError is the error a node returned to our query.
+	KRPCError struct {
+		Code    int64
+		Message string
+	}
+)
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func (m krpcMessage) encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": m.transactionID,
+		"y": m.kind,
+	}
+
+	switch m.kind {
+	case krpcQuery:
+		args := map[string]interface{}{"id": string(m.args.id[:])}
+		switch m.method {
+		case methodFindNode:
+			args["target"] = string(m.args.target[:])
+		case methodGetPeers:
+			args["info_hash"] = string(m.args.infoHash[:])
+		case methodAnnouncePeer:
+			args["info_hash"] = string(m.args.infoHash[:])
+			args["token"] = m.args.token
+			args["port"] = m.args.port
+			if m.args.impliedPort {
+				args["implied_port"] = 1
+			}
+		}
+		dict["q"] = m.method
+		dict["a"] = args
+	case krpcResponse:
+		values := map[string]interface{}{"id": string(m.values.id[:])}
+		if m.values.nodes != nil {
+			values["nodes"] = compactNodes(m.values.nodes)
+		}
+		if len(m.values.values) > 0 {
+			peers := make([]interface{}, len(m.values.values))
+			for i, peer := range m.values.values {
+				peers[i] = peer
+			}
+			values["values"] = peers
+		}
+		if m.values.token != "" {
+			values["token"] = m.values.token
+		}
+		dict["r"] = values
+	case krpcError:
+		dict["e"] = []interface{}{m.errCode, m.errMessage}
+	default:
+		return nil, fmt.Errorf("unknown message type %q", m.kind)
+	}
+
+	return bencode.Encode(dict)
+}
+
+func parseKRPC(data []byte) (krpcMessage, error) {
+	value, _, err := bencode.DecodePrefix(data)
+	if err != nil {
+		return krpcMessage{}, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return krpcMessage{}, fmt.Errorf("message is not a dictionary")
+	}
+
+	m := krpcMessage{}
+	m.transactionID, _ = dict["t"].(string)
+	m.kind, _ = dict["y"].(string)
+
+	switch m.kind {
+	case krpcQuery:
+		m.method, _ = dict["q"].(string)
+		args, ok := dict["a"].(map[string]interface{})
+		if !ok {
+			return krpcMessage{}, fmt.Errorf("query arguments are missing")
+		}
+		if m.args, err = parseArgs(args); err != nil {
+			return krpcMessage{}, err
+		}
+	case krpcResponse:
+		values, ok := dict["r"].(map[string]interface{})
+		if !ok {
+			return krpcMessage{}, fmt.Errorf("response values are missing")
+		}
+		if m.values, err = parseValues(values); err != nil {
+			return krpcMessage{}, err
+		}
+	case krpcError:
+		e, ok := dict["e"].([]interface{})
+		if !ok || len(e) != 2 {
+			return krpcMessage{}, fmt.Errorf("malformed error")
+		}
+		m.errCode, _ = e[0].(int64)
+		m.errMessage, _ = e[1].(string)
+	default:
+		return krpcMessage{}, fmt.Errorf("unknown message type %q", m.kind)
+	}
+
+	return m, nil
+}
+
+func parseArgs(dict map[string]interface{}) (krpcArgs, error) {
+	args := krpcArgs{}
+	var err error
+	if args.id, err = parseID(dict, "id"); err != nil {
+		return krpcArgs{}, err
+	}
+	if _, ok := dict["target"]; ok {
+		if args.target, err = parseID(dict, "target"); err != nil {
+			return krpcArgs{}, err
+		}
+	}
+	if _, ok := dict["info_hash"]; ok {
+		if args.infoHash, err = parseID(dict, "info_hash"); err != nil {
+			return krpcArgs{}, err
+		}
+	}
+	args.token, _ = dict["token"].(string)
+	if port, ok := dict["port"].(int64); ok {
+		args.port = int(port)
+	}
+	if impliedPort, ok := dict["implied_port"].(int64); ok {
+		args.impliedPort = impliedPort != 0
+	}
+	return args, nil
+}
+
+func parseValues(dict map[string]interface{}) (krpcValues, error) {
+	values := krpcValues{}
+	var err error
+	if values.id, err = parseID(dict, "id"); err != nil {
+		return krpcValues{}, err
+	}
+	if nodes, ok := dict["nodes"].(string); ok {
+		if values.nodes, err = parseCompactNodes(nodes); err != nil {
+			return krpcValues{}, err
+		}
+	}
+	if peers, ok := dict["values"].([]interface{}); ok {
+		for _, peer := range peers {
+			if s, ok := peer.(string); ok && len(s) == 6 {
+				values.values = append(values.values, s)
+			}
+		}
+	}
+	values.token, _ = dict["token"].(string)
+	return values, nil
+}
+
+func parseID(dict map[string]interface{}, key string) (NodeID, error) {
+	s, ok := dict[key].(string)
+	if !ok || len(s) != idLen {
+		return NodeID{}, fmt.Errorf("%s is missing or malformed", key)
+	}
+	var id NodeID
+	copy(id[:], s)
+	return id, nil
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+const alpha = 3 // the number of queries a lookup keeps in flight
+
+type (
+	lookupResult struct {
+		peers   []string        // compact peer infos, only get_peers finds them
+		closest []respondedNode // up to k nodes closest to the target that answered
+	}
+
+	respondedNode struct {
+		node
+		token string
+	}
+
+	lookupAnswer struct {
+		node node
+		resp krpcMessage
+		err  error
+	}
+)
+
+// GetPeers looks up the peers of the torrent in the DHT, the lookup ends early when the context is done.
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]model.PeerInfo, error) {
+	res := d.lookup(ctx, infoHash, methodGetPeers)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.closest) == 0 {
+		return nil, fmt.Errorf("no dht node answered")
+	}
+	return toPeerInfos(res.peers)
+}
+
+// Announce looks up the peers of the torrent and announces to the closest nodes that we download it on the port.
+// The lookup and the announces end early when the context is done.
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]model.PeerInfo, error) {
+	res := d.lookup(ctx, infoHash, methodGetPeers)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.closest) == 0 {
+		return nil, fmt.Errorf("no dht node answered")
+	}
+
+	wg := sync.WaitGroup{}
+	for _, n := range res.closest {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n respondedNode) {
+			defer wg.Done()
+			_, _ = d.query(ctx, n.addr, methodAnnouncePeer, krpcArgs{infoHash: infoHash, token: n.token, port: int(port)})
+		}(n)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return toPeerInfos(res.peers)
+}
+
+// lookup iteratively queries the nodes closest to the target, every answer brings nodes closer to it.
+// It ends once the k closest nodes known have all been queried, or when the context is done.
+func (d *DHT) lookup(ctx context.Context, target NodeID, method string) lookupResult {
+	candidates := d.table.closest(target, k)
+	known := make(map[NodeID]bool, len(candidates))
+	for _, n := range candidates {
+		known[n.id] = true
+	}
+	queried := make(map[NodeID]bool)
+	failed := make(map[NodeID]bool)
+	responded := make([]respondedNode, 0)
+	peers := make(map[string]bool)
+
+	for ctx.Err() == nil {
+		batch := nextBatch(candidates, queried, failed)
+		if len(batch) == 0 {
+			break
+		}
+
+		answers := make(chan lookupAnswer, len(batch))
+		for _, n := range batch {
+			queried[n.id] = true
+			go func(n node) {
+				resp, err := d.query(ctx, n.addr, method, krpcArgs{target: target, infoHash: target})
+				answers <- lookupAnswer{node: n, resp: resp, err: err}
+			}(n)
+		}
+
+		for range batch {
+			answer := <-answers
+			if answer.err != nil {
+				failed[answer.node.id] = true
+				if ctx.Err() == nil { // a canceled query says nothing about the node
+					d.table.failed(answer.node.id)
+				}
+				continue
+			}
+			responded = append(responded, respondedNode{node: answer.node, token: answer.resp.values.token})
+			for _, peer := range answer.resp.values.values {
+				peers[peer] = true
+			}
+			for _, n := range answer.resp.values.nodes {
+				if !known[n.id] && n.id != d.table.self {
+					known[n.id] = true
+					candidates = append(candidates, n)
+				}
+			}
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].id, candidates[j].id)
+		})
+	}
+
+	sort.Slice(responded, func(i, j int) bool {
+		return closer(target, responded[i].id, responded[j].id)
+	})
+	if len(responded) > k {
+		responded = responded[:k]
+	}
+
+	res := lookupResult{closest: responded, peers: make([]string, 0, len(peers))}
+	for peer := range peers {
+		res.peers = append(res.peers, peer)
+	}
+	return res
+}
+
+// nextBatch returns up to alpha nodes that weren't queried yet among the k closest candidates that didn't fail.
+func nextBatch(candidates []node, queried, failed map[NodeID]bool) []node {
+	batch := make([]node, 0, alpha)
+	window := 0
+	for _, n := range candidates {
+		if failed[n.id] {
+			continue
+		}
+		if window++; window > k {
+			break
+		}
+		if !queried[n.id] {
+			batch = append(batch, n)
+			if len(batch) == alpha {
+				break
+			}
+		}
+	}
+	return batch
+}
+
+func toPeerInfos(peers []string) ([]model.PeerInfo, error) {
+	return bencode.ParseCompactPeers([]byte(strings.Join(peers, "")), net.IPv4len)
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	idLen          = 20
+	compactNodeLen = idLen + 6 // node ID, IPv4 address and port
+
+	goodNodeAge = 15 * time.Minute // a node is good if it answered within this time
+	maxFailures = 2                // a node that failed to answer this many queries in a row is bad
+)
+
+type (
+	// NodeID identifies a node in the DHT, it shares the space of info hashes.
+	NodeID [idLen]byte
+
+	node struct {
+		id       NodeID
+		addr     *net.UDPAddr
+		lastSeen time.Time
+		failures int
+	}
+)
+
+// RandomNodeID returns a random ID for a new node.
+func RandomNodeID() (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return NodeID{}, fmt.Errorf("failed to generate node ID: %w", err)
+	}
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// distance returns the XOR metric between the IDs.
+func (id NodeID) distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to the target than b.
+func closer(target, a, b NodeID) bool {
+	da, db := target.distance(a), target.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits the IDs share.
+func commonPrefixLen(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return idLen * 8
+}
+
+func (n node) good() bool {
+	return n.failures < maxFailures && time.Since(n.lastSeen) < goodNodeAge
+}
+
+// compactAddr encodes an IPv4 address and port, other addresses can't be encoded compactly.
+func compactAddr(addr *net.UDPAddr) (string, bool) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	buf := make([]byte, 6)
+	copy(buf, ip4)
+	binary.BigEndian.PutUint16(buf[4:], uint16(addr.Port))
+	return string(buf), true
+}
+
+func parseCompactAddr(s string) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IP([]byte(s[:4])),
+		Port: int(binary.BigEndian.Uint16([]byte(s[4:6]))),
+	}
+}
+
+// compactNodes encodes the IPv4 nodes in the compact node info format.
+func compactNodes(nodes []node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		addr, ok := compactAddr(n.addr)
+		if !ok {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, addr...)
+	}
+	return string(buf)
+}
+
+func parseCompactNodes(s string) ([]node, error) {
+	if len(s)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("compact nodes length %d is not a multiple of %d", len(s), compactNodeLen)
+	}
+
+	nodes := make([]node, 0, len(s)/compactNodeLen)
+	for offset := 0; offset < len(s); offset += compactNodeLen {
+		n := node{addr: parseCompactAddr(s[offset+idLen : offset+compactNodeLen])}
+		copy(n.id[:], s[offset:offset+idLen])
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
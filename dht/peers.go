@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL       = 30 * time.Minute // announced peers are forgotten unless they announce again
+	maxPeerValues = 50               // the most peers returned by get_peers, it keeps the response within one packet
+)
+
+// peerStore keeps the peers announced to us for each info hash.
+type peerStore struct {
+	mux   sync.Mutex
+	peers map[NodeID]map[string]time.Time // compact peer info to the time of its last announce
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[NodeID]map[string]time.Time)}
+}
+
+func (s *peerStore) add(infoHash NodeID, peer string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		s.peers[infoHash] = peers
+	}
+	peers[peer] = time.Now()
+}
+
+func (s *peerStore) get(infoHash NodeID) []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	values := make([]string, 0)
+	for peer, announced := range s.peers[infoHash] {
+		if time.Since(announced) > peerTTL {
+			continue
+		}
+		values = append(values, peer)
+		if len(values) == maxPeerValues {
+			break
+		}
+	}
+	return values
+}
+
+// expire forgets the peers that didn't announce within peerTTL.
+func (s *peerStore) expire() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for infoHash, peers := range s.peers {
+		for peer, announced := range peers {
+			if time.Since(announced) > peerTTL {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const k = 8 // the size of a bucket and the number of nodes returned by a lookup
+
+// routingTable keeps the known nodes in k-buckets, bucket i holds the nodes that share exactly i leading bits with self.
+// Buckets close to self are small in ID space, so the table knows much more about the nodes near itself.
+type routingTable struct {
+	self NodeID
+
+	mux     sync.RWMutex
+	buckets [idLen*8 + 1][]node
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// seen records that the node answered, it is added to its bucket if there is room or a bad node to replace.
+func (rt *routingTable) seen(id NodeID, addr *net.UDPAddr) bool {
+	if id == rt.self {
+		return false
+	}
+
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	index := commonPrefixLen(rt.self, id)
+	bucket := rt.buckets[index]
+	for i, n := range bucket {
+		if n.id == id {
+			// most recently seen nodes are kept last
+			n.addr, n.lastSeen, n.failures = addr, time.Now(), 0
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return true
+		}
+	}
+
+	fresh := node{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < k {
+		rt.buckets[index] = append(bucket, fresh)
+		return true
+	}
+	for i, n := range bucket {
+		if !n.good() {
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), fresh)
+			return true
+		}
+	}
+	return false // good nodes are never evicted, long-lived nodes are the most reliable ones
+}
+
+// failed records that the node didn't answer, it is removed once it fails too often.
+func (rt *routingTable) failed(id NodeID) {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	index := commonPrefixLen(rt.self, id)
+	bucket := rt.buckets[index]
+	for i := range bucket {
+		if bucket[i].id != id {
+			continue
+		}
+		bucket[i].failures++
+		if bucket[i].failures >= maxFailures {
+			rt.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+		}
+		return
+	}
+}
+
+// closest returns up to n known nodes closest to the target.
+func (rt *routingTable) closest(target NodeID, n int) []node {
+	nodes := rt.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].id, nodes[j].id)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// nodes returns a copy of every node in the table.
+func (rt *routingTable) nodes() []node {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+
+	nodes := make([]node, 0)
+	for _, bucket := range rt.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	return nodes
+}
+
+func (rt *routingTable) size() int {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+
+	size := 0
+	for _, bucket := range rt.buckets {
+		size += len(bucket)
+	}
+	return size
+}
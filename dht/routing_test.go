@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b NodeID
+		want int
+	}{
+		{name: "equal", want: 160},
+		{name: "first bit", a: NodeID{0x80}, want: 0},
+		{name: "ninth bit", a: NodeID{0x00, 0x40}, b: NodeID{0x00, 0x00}, want: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commonPrefixLen(tt.a, tt.b); got != tt.want {
+				t.Errorf("commonPrefixLen() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutingTableBucketFull(t *testing.T) {
+	rt := newRoutingTable(NodeID{})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	// every ID with the first bit set falls into bucket 0
+	for i := 0; i < k; i++ {
+		if !rt.seen(NodeID{0x80, byte(i)}, addr) {
+			t.Fatalf("seen(%d) got = false, want true", i)
+		}
+	}
+	if rt.seen(NodeID{0x80, 0xff}, addr) {
+		t.Errorf("seen() of a full bucket of good nodes got = true, want false")
+	}
+
+	rt.buckets[0][3].lastSeen = time.Now().Add(-goodNodeAge)
+	if !rt.seen(NodeID{0x80, 0xff}, addr) {
+		t.Errorf("seen() replacing a questionable node got = false, want true")
+	}
+	if rt.size() != k {
+		t.Errorf("size() got = %v, want %v", rt.size(), k)
+	}
+
+	for i := 0; i < maxFailures; i++ {
+		rt.failed(NodeID{0x80, 0})
+	}
+	if rt.size() != k-1 {
+		t.Errorf("size() after failures got = %v, want %v", rt.size(), k-1)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := newRoutingTable(NodeID{})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	for _, id := range []NodeID{{0x01}, {0x10}, {0x80}, {0x11}} {
+		rt.seen(id, addr)
+	}
+
+	got := rt.closest(NodeID{0x10}, 2)
+	if len(got) != 2 || got[0].id != (NodeID{0x10}) || got[1].id != (NodeID{0x11}) {
+		t.Errorf("closest() got = %v", got)
+	}
+}
@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+type (
+	// state is persisted across restarts, a node that keeps its ID and contacts rejoins the DHT without bootstrapping.
+	state struct {
+		ID    string      `json:"id"`
+		Nodes []stateNode `json:"nodes"`
+	}
+
+	stateNode struct {
+		ID   string `json:"id"`
+		Addr string `json:"addr"`
+	}
+)
+
+func loadState(path string) (state, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state{}, err
+	}
+
+	s := state{}
+	if err = json.Unmarshal(content, &s); err != nil {
+		return state{}, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	return s, nil
+}
+
+// saveState replaces the state file atomically so a crash never leaves it half-written.
+func saveState(path string, s state) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newState(self NodeID, nodes []node) state {
+	s := state{ID: self.String(), Nodes: make([]stateNode, len(nodes))}
+	for i, n := range nodes {
+		s.Nodes[i] = stateNode{ID: n.id.String(), Addr: n.addr.String()}
+	}
+	return s
+}
+
+func parseStateID(s string) (NodeID, error) {
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != idLen {
+		return NodeID{}, fmt.Errorf("malformed node ID %q", s)
+	}
+	var id NodeID
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// stateNodes returns the nodes of the state, malformed ones are skipped.
+func stateNodes(s state) []node {
+	nodes := make([]node, 0, len(s.Nodes))
+	for _, sn := range s.Nodes {
+		id, err := parseStateID(sn.ID)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", sn.Addr)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, node{id: id, addr: addr})
+	}
+	return nodes
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+)
+
+// tokens are handed out with get_peers and checked on announce_peer, they prove that the announcing node
+// owns its IP address. A token is the hash of the IP and a secret that is rotated every tokenRotation,
+// tokens made with the previous secret are still accepted.
+type tokens struct {
+	mux      sync.RWMutex
+	secret   [20]byte
+	previous [20]byte
+}
+
+func newTokens() *tokens {
+	t := &tokens{}
+	t.rotate()
+	t.previous = t.secret
+	return t
+}
+
+func (t *tokens) rotate() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.previous = t.secret
+	_, _ = rand.Read(t.secret[:])
+}
+
+func (t *tokens) token(ip net.IP) string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return makeToken(t.secret, ip)
+}
+
+func (t *tokens) valid(token string, ip net.IP) bool {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return token == makeToken(t.secret, ip) || token == makeToken(t.previous, ip)
+}
+
+func makeToken(secret [20]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.To16())
+	return string(h.Sum(nil)[:8])
+}
@@ -0,0 +1,161 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	minAnnounceInterval     = time.Minute
+	wantedPeers             = 30 // below it the tracker's min interval is used to get more peers sooner
+	dhtAnnounceInterval     = 15 * time.Minute
+	announceTimeout         = time.Minute // enough for an HTTP tracker and two attempts on a UDP tracker
+)
+
+// runAnnouncer announces started, then re-announces on the tracker's interval until the context is done.
+// Completed is announced once the download finishes, stopped is announced by announceExit.
+func (t *Torrent) runAnnouncer(ctx context.Context) {
+	completed := t.done
+	if t.isComplete() {
+		completed = nil // nothing was downloaded in this session
+	}
+
+	t.event = client.EventStarted
+	for {
+		trackerInfo, answered := t.announce(ctx, t.event)
+		if answered {
+			t.event = client.EventNone
+			if t.completedPending {
+				t.completedPending = false
+				t.event = client.EventCompleted
+				continue
+			}
+		}
+
+		timer := time.NewTimer(t.nextAnnounce(trackerInfo, answered))
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			t.queueCompleted()
+		case <-ctx.Done():
+			timer.Stop()
+			if completed != nil && isClosed(completed) {
+				t.queueCompleted()
+			}
+			return
+		}
+	}
+}
+
+// queueCompleted makes completed the event of the next announce, or of the one after started
+// if no tracker answered started yet.
+func (t *Torrent) queueCompleted() {
+	switch t.event {
+	case client.EventNone:
+		t.event = client.EventCompleted
+	case client.EventStarted:
+		t.completedPending = true
+	}
+}
+
+// announceExit tells the trackers that we leave, it is called once the announcer exited.
+func (t *Torrent) announceExit(ctx context.Context) {
+	event := t.event
+	t.event = client.EventStarted
+	t.completedPending = false
+	if event == client.EventStarted { // the trackers never knew about us
+		return
+	}
+	if event == client.EventCompleted {
+		t.announce(ctx, client.EventCompleted)
+	}
+	t.announce(ctx, client.EventStopped)
+}
+
+// announce reports the current stats to the trackers and connects to the returned peers.
+func (t *Torrent) announce(ctx context.Context, event client.Event) (model.TrackerInfo, bool) {
+	ctx, cancel := context.WithTimeout(ctx, announceTimeout)
+	defer cancel()
+
+	trackerInfo, err := t.trackers.Announce(ctx, client.AnnounceParams{
+		InfoHash:   t.torrentInfo.InfoHash,
+		PeerID:     t.peerID,
+		Port:       t.port,
+		Uploaded:   atomic.LoadInt64(&t.uploaded),
+		Downloaded: atomic.LoadInt64(&t.downloaded),
+		Left:       t.bytesLeft(),
+		Event:      event,
+	})
+	answered := !errors.Is(err, client.ErrNoTrackerAnswered)
+	if err != nil {
+		log.Printf("failed to announce %q, torrent name: %s, err: %s", event, t.info().Name, err.Error())
+	}
+
+	if event != client.EventStopped {
+		t.connectToPeers(trackerInfo.Peers)
+	}
+	return trackerInfo, answered
+}
+
+// runDHTAnnouncer announces the torrent to the DHT on dhtAnnounceInterval until the context is done,
+// the peers found there are connected like the ones from trackers.
+func (t *Torrent) runDHTAnnouncer(ctx context.Context) {
+	if t.dht == nil {
+		return
+	}
+
+	for {
+		// the metadata of a magnet torrent is unknown at first, so it is checked on every round
+		if !t.info().Private {
+			peers, err := t.dht.Announce(ctx, t.torrentInfo.InfoHash, t.port)
+			if err != nil {
+				log.Printf("failed to announce to dht, torrent name: %s, err: %s", t.info().Name, err.Error())
+			}
+			t.connectToPeers(peers)
+		}
+
+		timer := time.NewTimer(dhtAnnounceInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (t *Torrent) nextAnnounce(trackerInfo model.TrackerInfo, answered bool) time.Duration {
+	if !answered {
+		return minAnnounceInterval
+	}
+
+	interval := time.Duration(trackerInfo.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	if trackerInfo.MinInterval > 0 && t.peers.count() < wantedPeers {
+		interval = time.Duration(trackerInfo.MinInterval) * time.Second
+	}
+	if interval < minAnnounceInterval {
+		interval = minAnnounceInterval
+	}
+	return interval
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+func TestAnnouncerCompletedBeforeStarted(t *testing.T) {
+	var mux sync.Mutex
+	var events []string
+	announced := make(chan struct{}, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mux.Unlock()
+		_, _ = w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		announced <- struct{}{}
+	}))
+	defer server.Close()
+
+	torrentInfo := model.TorrentInfo{
+		Announce:    server.URL + "/announce",
+		InfoHash:    [20]byte{9},
+		PieceHashes: [][20]byte{{1}},
+		PieceLength: blockSize,
+		Length:      blockSize,
+		Name:        "announce",
+	}
+	torrent, err := NewTorrent([20]byte{'a'}, torrentInfo, time.Second, storage.NewMemoryStorage(torrentInfo))
+	if err != nil {
+		t.Fatalf("NewTorrent() error = %v", err)
+	}
+
+	// the download finished while no tracker answered started yet
+	torrent.event = client.EventStarted
+	torrent.queueCompleted()
+	if !torrent.completedPending || torrent.event != client.EventStarted {
+		t.Fatalf("queueCompleted() got pending = %v, event = %q, want completed after started", torrent.completedPending, torrent.event)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		torrent.runAnnouncer(ctx)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-announced:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("announce #%d didn't come", i)
+		}
+	}
+	cancel()
+	<-finished
+
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"started", "completed"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("runAnnouncer() events got = %v, want %v", events, want)
+	}
+}
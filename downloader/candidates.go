@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+const (
+	maxCandidates       = 500 // peers learnt beyond it are dropped until the list drains
+	maxPeers            = 50  // the most connections a torrent keeps
+	connectInterval     = time.Second
+	connectsPerInterval = 10 // dials started per connectInterval, so a burst of peers doesn't open hundreds of sockets
+)
+
+// candidates are the peers learnt from trackers, the DHT and other peers that we aren't connected to yet.
+// They are dialed in the order they were learnt.
+type candidates struct {
+	mux   sync.Mutex
+	queue []model.PeerInfo
+	known map[string]bool // addresses in the queue
+}
+
+func newCandidates() *candidates {
+	return &candidates{
+		queue: make([]model.PeerInfo, 0),
+		known: make(map[string]bool),
+	}
+}
+
+// add queues the peers that aren't queued yet while there is room and returns how many were queued.
+func (c *candidates) add(peers []model.PeerInfo) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	added := 0
+	for _, peer := range peers {
+		if len(c.queue) >= maxCandidates {
+			break
+		}
+		address := peerAddress(peer)
+		if c.known[address] {
+			continue
+		}
+		c.known[address] = true
+		c.queue = append(c.queue, peer)
+		added++
+	}
+	return added
+}
+
+// take removes up to n peers from the front of the queue.
+func (c *candidates) take(n int) []model.PeerInfo {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if n > len(c.queue) {
+		n = len(c.queue)
+	}
+	taken := append([]model.PeerInfo(nil), c.queue[:n]...)
+	c.queue = c.queue[n:]
+	for _, peer := range taken {
+		delete(c.known, peerAddress(peer))
+	}
+	return taken
+}
+
+func (c *candidates) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return len(c.queue)
+}
+
+func peerAddress(peer model.PeerInfo) string {
+	host := peer.Host
+	if peer.IP != nil {
+		host = peer.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(peer.Port)))
+}
+
+// runConnector dials candidates while the torrent has room for more connections, until the torrent is complete
+// or the run ends.
+func (t *Torrent) runConnector(r *run) {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		n := maxPeers - t.peers.count() - t.numDialing()
+		if n > connectsPerInterval {
+			n = connectsPerInterval
+		}
+		if n > 0 {
+			for _, peer := range t.candidates.take(n) {
+				t.dial(r, peer)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package downloader
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	chokeInterval      = 10 * time.Second
+	optimisticRounds   = 3 // the optimistic unchoke is rotated every third round, every 30 seconds
+	defaultUploadSlots = 4
+)
+
+type (
+	// choker decides which peers may download from us: tit-for-tat with the peers that give us the most,
+	// plus one optimistic slot that lets a random peer prove itself.
+	choker struct {
+		mux        sync.Mutex // held while the choke states of the peers are decided and changed
+		slots      int
+		round      int
+		optimistic *Peer
+		last       map[*Peer]transferred // the counters of the peers at the previous round
+	}
+
+	transferred struct {
+		downloaded int64
+		uploaded   int64
+	}
+)
+
+func newChoker(slots int) choker {
+	return choker{slots: slots, last: make(map[*Peer]transferred)}
+}
+
+// runChoker rechokes the peers every chokeInterval until stop is closed.
+func (t *Torrent) runChoker(stop <-chan struct{}) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		t.peers.rechoke(t.isComplete())
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rechoke unchokes the interested peers with the best rates since the previous round, the rate is
+// how fast a peer uploads to us while we download and how fast it downloads from us while we seed.
+// The peers are told after the choker is unlocked, so a peer that is slow to read doesn't hold up the others.
+func (p *Peers) rechoke(seeding bool) {
+	for _, peer := range p.decideChokes(seeding) {
+		if err := peer.sendChokeState(); err != nil {
+			log.Printf("failed to change choke state of peer, peerIP: %s, err: %s", peer.ip, err.Error())
+		}
+	}
+}
+
+// decideChokes sets the choke states of the round and returns the peers whose state changed.
+func (p *Peers) decideChokes(seeding bool) []*Peer {
+	c := &p.choker
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	peers := p.list()
+
+	rates := make(map[*Peer]int64, len(peers))
+	last := make(map[*Peer]transferred, len(peers))
+	for _, peer := range peers {
+		now := transferred{
+			downloaded: atomic.LoadInt64(&peer.downloaded),
+			uploaded:   atomic.LoadInt64(&peer.uploaded),
+		}
+		prev := c.last[peer]
+		if seeding {
+			rates[peer] = now.uploaded - prev.uploaded
+		} else {
+			rates[peer] = now.downloaded - prev.downloaded
+		}
+		last[peer] = now
+	}
+	c.last = last // disconnected peers are forgotten
+
+	interested := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.isInterested() {
+			interested = append(interested, peer)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoke := make(map[*Peer]bool, c.slots+1)
+	for i := 0; i < len(interested) && i < c.slots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	_, connected := last[c.optimistic]
+	if c.round%optimisticRounds == 0 || !connected || !c.optimistic.isInterested() {
+		c.optimistic = pickOptimistic(interested, unchoke)
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	c.round++
+
+	changed := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.setUnchoked(unchoke[peer]) {
+			changed = append(changed, peer)
+		}
+	}
+	return changed
+}
+
+// unchokeIfFree unchokes the peer right away if a slot is free, so new peers don't wait for the next round.
+func (p *Peers) unchokeIfFree(peer *Peer) error {
+	if !p.takeFreeSlot(peer) {
+		return nil
+	}
+	return peer.sendChokeState()
+}
+
+// takeFreeSlot unchokes the peer if a slot is free and reports whether its state changed.
+func (p *Peers) takeFreeSlot(peer *Peer) bool {
+	p.choker.mux.Lock()
+	defer p.choker.mux.Unlock()
+
+	unchoked := 0
+	for _, other := range p.list() {
+		if other.isUnchoked() {
+			unchoked++
+		}
+	}
+	if unchoked >= p.choker.slots {
+		return false
+	}
+	return peer.setUnchoked(true)
+}
+
+// pickOptimistic returns a random interested peer that didn't earn a regular slot, or nil if there is none.
+func pickOptimistic(interested []*Peer, unchoke map[*Peer]bool) *Peer {
+	candidates := make([]*Peer, 0, len(interested))
+	for _, peer := range interested {
+		if !unchoke[peer] {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (p *Peer) isInterested() bool {
+	return atomic.LoadInt32(&p.interested) == 1
+}
+
+func (p *Peer) isUnchoked() bool {
+	return atomic.LoadInt32(&p.unchoked) == 1
+}
+
+// setUnchoked changes the choke state and reports whether it changed, sendChokeState tells the peer.
+func (p *Peer) setUnchoked(unchoked bool) bool {
+	if unchoked {
+		return atomic.CompareAndSwapInt32(&p.unchoked, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&p.unchoked, 1, 0)
+}
+
+// sendChokeState sends choke or unchoke for the current state. The state is read under the write lock,
+// so the last message the peer gets matches the last change even if changes race.
+func (p *Peer) sendChokeState() error {
+	p.writeMux.Lock()
+	defer p.writeMux.Unlock()
+
+	if p.isUnchoked() {
+		return p.write(NewUnchoke())
+	}
+	return p.write(NewChoke())
+}
@@ -0,0 +1,157 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardConn swallows whatever is written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestRechoke(t *testing.T) {
+	peers := Peers{peers: make(map[string]*Peer), peersChan: make(chan *Peer, 8), choker: newChoker(2)}
+	rates := map[string]int64{"a": 100, "b": 50, "c": 10, "d": 1000, "e": 5}
+	for ip, rate := range rates {
+		peer := &Peer{conn: discardConn{}, ip: ip, downloaded: rate}
+		if ip != "d" {
+			peer.interested = 1
+		}
+		if err := peers.addPeer(ip, peer); err != nil {
+			t.Fatalf("addPeer() error = %v", err)
+		}
+	}
+
+	peers.rechoke(false)
+	optimistic := peers.choker.optimistic
+	if optimistic == nil || (optimistic.ip != "c" && optimistic.ip != "e") {
+		t.Fatalf("optimistic got = %v, want c or e", optimistic)
+	}
+	for ip, peer := range peers.peers {
+		want := ip == "a" || ip == "b" || peer == optimistic
+		if peer.isUnchoked() != want {
+			t.Errorf("isUnchoked() of %s got = %v, want %v", ip, !want, want)
+		}
+	}
+
+	// the optimistic slot is kept until its round comes
+	peers.rechoke(false)
+	if peers.choker.optimistic != optimistic {
+		t.Errorf("optimistic got = %v, want %v", peers.choker.optimistic.ip, optimistic.ip)
+	}
+
+	// nobody transferred anything since the last round, seeding ranks by upload rate
+	peers.peers["e"].uploaded = 500
+	peers.rechoke(true)
+	if !peers.peers["e"].isUnchoked() {
+		t.Errorf("isUnchoked() of e got = false, want true")
+	}
+}
+
+func TestUnchokeIfFree(t *testing.T) {
+	peers := Peers{peers: make(map[string]*Peer), peersChan: make(chan *Peer, 16), choker: newChoker(2)}
+	for i := 0; i < 16; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		if err := peers.addPeer(ip, &Peer{conn: discardConn{}, ip: ip, interested: 1}); err != nil {
+			t.Fatalf("addPeer() error = %v", err)
+		}
+	}
+
+	// interested messages arrive at once, the slots are never exceeded
+	var wg sync.WaitGroup
+	for _, peer := range peers.list() {
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			if err := peers.unchokeIfFree(peer); err != nil {
+				t.Errorf("unchokeIfFree() error = %v", err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	unchoked := 0
+	for _, peer := range peers.list() {
+		if peer.isUnchoked() {
+			unchoked++
+		}
+	}
+	if unchoked != 2 {
+		t.Errorf("unchokeIfFree() unchoked %d peers, want 2", unchoked)
+	}
+}
+
+// stalledConn blocks writes until it is released, like a peer that stopped reading its socket.
+type stalledConn struct {
+	discardConn
+	release chan struct{}
+}
+
+func (c stalledConn) Write(b []byte) (int, error) {
+	<-c.release
+	return len(b), nil
+}
+
+func TestRechokeStalledPeer(t *testing.T) {
+	peers := Peers{peers: make(map[string]*Peer), peersChan: make(chan *Peer, 8), choker: newChoker(2)}
+	release := make(chan struct{})
+	defer close(release)
+	stalled := &Peer{conn: stalledConn{release: release}, ip: "stalled", interested: 1}
+	if err := peers.addPeer(stalled.ip, stalled); err != nil {
+		t.Fatalf("addPeer() error = %v", err)
+	}
+	go peers.rechoke(false)
+
+	// the choker isn't held while the stalled peer is told it is unchoked
+	other := &Peer{conn: discardConn{}, ip: "other", interested: 1}
+	done := make(chan error, 1)
+	go func() {
+		for !stalled.isUnchoked() {
+			time.Sleep(time.Millisecond)
+		}
+		done <- peers.unchokeIfFree(other)
+	}()
+	select {
+	case err := <-done:
+		if err != nil || !other.isUnchoked() {
+			t.Errorf("unchokeIfFree() error = %v, unchoked = %v, want the peer unchoked", err, other.isUnchoked())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("unchokeIfFree() is blocked by the stalled peer")
+	}
+}
+
+func TestWithUploadSlots(t *testing.T) {
+	tests := []struct {
+		slots   int
+		wantErr bool
+	}{
+		{slots: -1, wantErr: true},
+		{slots: 0, wantErr: true},
+		{slots: 1},
+		{slots: 8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d slots", tt.slots), func(t *testing.T) {
+			d, err := NewTorrentDownloader([20]byte{}, nil, time.Second, WithUploadSlots(tt.slots))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTorrentDownloader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && d.options.slots != tt.slots {
+				t.Errorf("NewTorrentDownloader() got slots = %d, want %d", d.options.slots, tt.slots)
+			}
+		})
+	}
+}
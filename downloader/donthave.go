@@ -0,0 +1,30 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// lt_donthave tells that a peer lost a piece it announced before, see http://bittorrent.org/beps/bep_0054.html
+const ltDonthave = "lt_donthave"
+
+type donthaveExtension struct {
+	t *Torrent
+}
+
+func (e *donthaveExtension) Name() string {
+	return ltDonthave
+}
+
+func (e *donthaveExtension) OnHandshake(*Peer) error {
+	return nil
+}
+
+// HandleMessage removes the piece from the bitfield of the peer and from the availability.
+func (e *donthaveExtension) HandleMessage(peer *Peer, payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("expected payload length 4, got length %d", len(payload))
+	}
+	e.t.peerLost(peer, int(binary.BigEndian.Uint32(payload)))
+	return nil
+}
@@ -1,53 +1,174 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/genvmoroz/simple-torrent-client/model"
 )
 
 type TorrentDownloader struct {
-	peerID   [20]byte // shouldn't be changed
-	torrents []*Torrent
+	peerID  [20]byte // shouldn't be changed
+	timeout time.Duration
+	options options
+
+	torrentsMux sync.RWMutex
+	torrents    []*Torrent
+
+	listenerMux sync.Mutex
+	listener    net.Listener // nil until Listen is called
+	serving     sync.WaitGroup
 }
 
-func NewTorrentDownloader(peerID [20]byte, torrentInfo []model.TorrentInfo, timeout time.Duration) (*TorrentDownloader, error) {
-	torrents := make([]*Torrent, len(torrentInfo))
+func NewTorrentDownloader(peerID [20]byte, torrentInfo []model.TorrentInfo, timeout time.Duration, opts ...Option) (*TorrentDownloader, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.slots < 1 {
+		return nil, fmt.Errorf("upload slots must be at least 1, got %d", o.slots)
+	}
+
+	d := &TorrentDownloader{
+		peerID:   peerID,
+		timeout:  timeout,
+		options:  o,
+		torrents: make([]*Torrent, 0, len(torrentInfo)),
+	}
 
-	for index, ti := range torrentInfo {
-		torrent, err := NewTorrent(peerID, ti, timeout)
+	for _, ti := range torrentInfo {
+		store, err := o.storage(ti)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage for torrent, name: %s, err: %w", ti.Name, err)
+		}
+		torrent, err := NewTorrent(peerID, ti, timeout, store)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create a new Torrent: %w", err)
 		}
-		torrents[index] = torrent
+		d.add(torrent)
 	}
 
-	return &TorrentDownloader{
-		peerID:   peerID,
-		torrents: torrents,
-	}, nil
+	return d, nil
 }
 
-func (d *TorrentDownloader) Download() error {
-	ticker := time.NewTicker(time.Minute)
+// AddMagnet adds a torrent known only by its magnet link, it must be called before Download.
+func (d *TorrentDownloader) AddMagnet(link model.Magnet) error {
+	torrent, err := NewMagnetTorrent(d.peerID, link, d.timeout, d.options.storage)
+	if err != nil {
+		return fmt.Errorf("failed to create a new Torrent: %w", err)
+	}
+	d.add(torrent)
+	return nil
+}
+
+// add applies the session settings to the torrent and adds it to the session.
+func (d *TorrentDownloader) add(t *Torrent) {
+	t.dht = d.options.dht
+	t.port = d.options.port
+	t.peers.choker.slots = d.options.slots
+	t.setPicker(d.options.picker)
 
-	for {
-		for _, torrent := range d.torrents {
-			if torrent == nil {
-				continue
+	d.torrentsMux.Lock()
+	defer d.torrentsMux.Unlock()
+
+	d.torrents = append(d.torrents, t)
+}
+
+// torrent returns the torrent with the info hash, or nil if the session has none.
+func (d *TorrentDownloader) torrent(infoHash [20]byte) *Torrent {
+	d.torrentsMux.RLock()
+	defer d.torrentsMux.RUnlock()
+
+	for _, t := range d.torrents {
+		if t.torrentInfo.InfoHash == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+// Torrents returns the torrents of the session.
+func (d *TorrentDownloader) Torrents() []*Torrent {
+	d.torrentsMux.RLock()
+	defer d.torrentsMux.RUnlock()
+
+	return append([]*Torrent(nil), d.torrents...)
+}
+
+// Listen accepts connections from peers on the port of the session in the background,
+// each connection is served by the torrent it asks for.
+func (d *TorrentDownloader) Listen() error {
+	listener, err := net.Listen(tcp, fmt.Sprintf(":%d", d.options.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	d.listenerMux.Lock()
+	d.listener = listener
+	d.listenerMux.Unlock()
+
+	d.serving.Add(1)
+	go func() {
+		defer d.serving.Done()
+		d.serve(listener)
+	}()
+	return nil
+}
+
+// Download starts every torrent and returns once all of them are complete or the context is done.
+// The torrents keep seeding afterwards until Shutdown is called.
+func (d *TorrentDownloader) Download(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for _, torrent := range d.Torrents() {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+
+			if err := t.Download(ctx); err != nil {
+				log.Printf("failed to download torrent, name: %s, err: %s", t.info().Name, err.Error())
+				return
 			}
-			go func(t *Torrent) {
-				if err := t.ConnectToPeers(); err != nil {
-					log.Printf("failed to connect to peers and download, torrent name: %s, err: %s", t.torrentInfo.Name, err.Error())
-				}
-			}(torrent)
+			log.Printf("torrent is downloaded, name: %s", t.info().Name)
+		}(torrent)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// Shutdown stops accepting peers and stops every torrent: the peers are disconnected, the trackers learn
+// we left and the storage is flushed and closed. It returns once every goroutine of the session exited,
+// or with the error of the context if it is done first.
+func (d *TorrentDownloader) Shutdown(ctx context.Context) error {
+	d.listenerMux.Lock()
+	if d.listener != nil {
+		if err := d.listener.Close(); err != nil {
+			log.Printf("failed to close listener, err: %s", err.Error())
 		}
+		d.listener = nil
+	}
+	d.listenerMux.Unlock()
 
-		select {
+	torrents := d.Torrents()
+	errs := make([]error, len(torrents))
+	wg := sync.WaitGroup{}
+	for index, torrent := range torrents {
+		wg.Add(1)
+		go func(index int, t *Torrent) {
+			defer wg.Done()
+			errs[index] = t.Stop(ctx)
+		}(index, torrent)
+	}
+	wg.Wait()
 
-		case <-ticker.C:
+	for index, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to stop torrent, name: %s, err: %w", torrents[index].info().Name, err)
 		}
 	}
+	return waitGroup(ctx, &d.serving)
 }
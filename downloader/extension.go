@@ -0,0 +1,321 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// Extension protocol, see http://bittorrent.org/beps/bep_0010.html
+const (
+	extendedHandshakeID uint8 = 0
+
+	clientVersion   = "simple-torrent-client"
+	maxRequestQueue = 250 // the number of outstanding requests we accept from a peer
+)
+
+type (
+	// Extension handles the messages of an extension negotiated with the extended handshake.
+	// The methods are called by the goroutine that serves the peer.
+	Extension interface {
+		// Name is the key of the extension in the m dictionary, e.g. ut_metadata.
+		Name() string
+		// OnHandshake is called once the peer announced the extension in its extended handshake.
+		OnHandshake(peer *Peer) error
+		// HandleMessage handles the payload of a message the peer sent to the extension.
+		HandleMessage(peer *Peer, payload []byte) error
+	}
+
+	// TickingExtension is implemented by extensions that send messages on their own.
+	// Tick is called about every second by the goroutine that serves a peer which supports the extension.
+	TickingExtension interface {
+		Extension
+		Tick(peer *Peer) error
+	}
+
+	// Extensions assigns extended message IDs to the registered extensions, peers use them to address our extensions.
+	Extensions struct {
+		mux        sync.RWMutex
+		extensions []Extension // the ID of an extension is its index + 1, 0 is the handshake
+	}
+
+	// ExtendedHandshake is the handshake of the extension protocol, zero fields are omitted.
+	ExtendedHandshake struct {
+		M            map[string]uint8 // extension names to extended message IDs, 0 disables an extension
+		V            string           // client name and version
+		P            uint16           // local TCP listen port
+		Reqq         int              // the number of outstanding requests the client accepts
+		YourIP       net.IP           // the IP of the receiver as the sender sees it
+		MetadataSize int              // the size of the info dictionary, see http://bittorrent.org/beps/bep_0009.html
+	}
+)
+
+func NewExtensions() *Extensions {
+	return &Extensions{}
+}
+
+// Register assigns the next free extended message ID to the extension.
+func (e *Extensions) Register(ext Extension) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	for _, registered := range e.extensions {
+		if registered.Name() == ext.Name() {
+			return fmt.Errorf("extension %s is already registered", ext.Name())
+		}
+	}
+	if len(e.extensions) == 255 {
+		return fmt.Errorf("no extended message ID is left for extension %s", ext.Name())
+	}
+
+	e.extensions = append(e.extensions, ext)
+	return nil
+}
+
+// get returns the extension with the ID, or nil if there is none.
+func (e *Extensions) get(id uint8) Extension {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	if id == extendedHandshakeID || int(id) > len(e.extensions) {
+		return nil
+	}
+	return e.extensions[id-1]
+}
+
+// byName returns the extension with the name, or nil if there is none.
+func (e *Extensions) byName(name string) Extension {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	for _, ext := range e.extensions {
+		if ext.Name() == name {
+			return ext
+		}
+	}
+	return nil
+}
+
+// all returns the registered extensions.
+func (e *Extensions) all() []Extension {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	return append([]Extension(nil), e.extensions...)
+}
+
+// ids returns the m dictionary of our extended handshake.
+func (e *Extensions) ids() map[string]uint8 {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	m := make(map[string]uint8, len(e.extensions))
+	for index, ext := range e.extensions {
+		m[ext.Name()] = uint8(index + 1)
+	}
+	return m
+}
+
+// Encode returns the bencoded handshake.
+func (h ExtendedHandshake) Encode() ([]byte, error) {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.P != 0 {
+		dict["p"] = h.P
+	}
+	if h.Reqq != 0 {
+		dict["reqq"] = h.Reqq
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = string(ip4)
+	} else if len(h.YourIP) == net.IPv6len {
+		dict["yourip"] = string(h.YourIP)
+	}
+	if h.MetadataSize != 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+
+	return bencode.Encode(dict)
+}
+
+// ParseExtendedHandshake parses the payload of an extended handshake, unknown and malformed fields are ignored.
+func ParseExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	value, _, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return ExtendedHandshake{}, fmt.Errorf("failed to decode handshake: %w", err)
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return ExtendedHandshake{}, fmt.Errorf("handshake is not a dictionary")
+	}
+
+	h := ExtendedHandshake{M: make(map[string]uint8)}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, rawID := range m {
+			if id, ok := rawID.(int64); ok && id >= 0 && id <= 255 {
+				h.M[name] = uint8(id)
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		h.V = v
+	}
+	if p, ok := dict["p"].(int64); ok && p > 0 && p <= 65535 {
+		h.P = uint16(p)
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		h.Reqq = int(reqq)
+	}
+	if yourIP, ok := dict["yourip"].(string); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		h.YourIP = net.IP(yourIP)
+	}
+	if size, ok := dict["metadata_size"].(int64); ok && size > 0 {
+		h.MetadataSize = int(size)
+	}
+
+	return h, nil
+}
+
+// ExtendedHandshake returns the last extended handshake of the peer, false if the peer didn't send one yet.
+// The m dictionary holds only the extensions that are enabled.
+func (p *Peer) ExtendedHandshake() (ExtendedHandshake, bool) {
+	if p.handshake == nil {
+		return ExtendedHandshake{}, false
+	}
+	return *p.handshake, true
+}
+
+// SupportsExtension reports whether the peer announced the extension in its extended handshake.
+func (p *Peer) SupportsExtension(name string) bool {
+	if p.handshake == nil {
+		return false
+	}
+	_, ok := p.handshake.M[name]
+	return ok
+}
+
+// WriteExtended sends the payload to the extension of the peer with the name.
+func (p *Peer) WriteExtended(name string, payload []byte) error {
+	if !p.SupportsExtension(name) {
+		return fmt.Errorf("peer doesn't support extension %s", name)
+	}
+	return p.WriteMessage(NewExtended(p.handshake.M[name], payload))
+}
+
+// updateHandshake applies the extended handshake, a repeated handshake updates only the fields it carries.
+func (p *Peer) updateHandshake(h ExtendedHandshake) {
+	if p.handshake == nil {
+		p.handshake = &ExtendedHandshake{M: make(map[string]uint8)}
+	}
+	for name, id := range h.M {
+		if id == 0 {
+			delete(p.handshake.M, name)
+			continue
+		}
+		p.handshake.M[name] = id
+	}
+	if h.V != "" {
+		p.handshake.V = h.V
+	}
+	if h.P != 0 {
+		p.handshake.P = h.P
+	}
+	if h.Reqq != 0 {
+		p.handshake.Reqq = h.Reqq
+	}
+	if h.YourIP != nil {
+		p.handshake.YourIP = h.YourIP
+	}
+	if h.MetadataSize != 0 {
+		p.handshake.MetadataSize = h.MetadataSize
+	}
+}
+
+// RegisterExtension adds an extension that is announced to the peers connected afterwards.
+func (t *Torrent) RegisterExtension(ext Extension) error {
+	return t.extensions.Register(ext)
+}
+
+func (t *Torrent) sendExtendedHandshake(peer *Peer) error {
+	handshake := ExtendedHandshake{
+		M:    t.extensions.ids(),
+		V:    clientVersion,
+		P:    t.port,
+		Reqq: maxRequestQueue,
+	}
+	if addr, ok := peer.conn.RemoteAddr().(*net.TCPAddr); ok {
+		handshake.YourIP = addr.IP
+	}
+	if t.hasMetadata() {
+		handshake.MetadataSize = len(t.info().RawInfo)
+	}
+
+	payload, err := handshake.Encode()
+	if err != nil {
+		return err
+	}
+	return peer.WriteMessage(NewExtended(extendedHandshakeID, payload))
+}
+
+func (t *Torrent) handleExtended(peer *Peer, msg *Message) error {
+	id, payload, err := ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if id == extendedHandshakeID {
+		return t.handleExtendedHandshake(peer, payload)
+	}
+	ext := t.extensions.get(id)
+	if ext == nil {
+		return nil // an extension we didn't announce, ignore it
+	}
+	if err = ext.HandleMessage(peer, payload); err != nil {
+		return fmt.Errorf("failed to handle %s message: %w", ext.Name(), err)
+	}
+	return nil
+}
+
+func (t *Torrent) handleExtendedHandshake(peer *Peer, payload []byte) error {
+	handshake, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+	peer.updateHandshake(handshake)
+
+	for name, id := range handshake.M {
+		if id == 0 {
+			continue
+		}
+		ext := t.extensions.byName(name)
+		if ext == nil {
+			continue
+		}
+		if err = ext.OnHandshake(peer); err != nil {
+			return fmt.Errorf("failed to start %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// tickExtensions gives the extensions the peer supports a chance to send their periodic messages.
+func (t *Torrent) tickExtensions(peer *Peer) error {
+	for _, ext := range t.extensions.all() {
+		ticking, ok := ext.(TickingExtension)
+		if !ok || !peer.SupportsExtension(ext.Name()) {
+			continue
+		}
+		if err := ticking.Tick(peer); err != nil {
+			return fmt.Errorf("failed to tick %s: %w", ext.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type testExtension struct {
+	name string
+}
+
+func (e *testExtension) Name() string                      { return e.name }
+func (e *testExtension) OnHandshake(*Peer) error           { return nil }
+func (e *testExtension) HandleMessage(*Peer, []byte) error { return nil }
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake ExtendedHandshake
+	}{
+		{
+			name: "all fields",
+			handshake: ExtendedHandshake{
+				M:            map[string]uint8{"ut_metadata": 1, "ut_pex": 2, "lt_donthave": 0},
+				V:            "test client 1.0",
+				P:            6881,
+				Reqq:         250,
+				YourIP:       net.IP{10, 0, 0, 1},
+				MetadataSize: 31235,
+			},
+		},
+		{
+			name: "ipv6",
+			handshake: ExtendedHandshake{
+				M:      map[string]uint8{},
+				YourIP: net.ParseIP("2001:db8::1"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.handshake.Encode()
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			got, err := ParseExtendedHandshake(payload)
+			if err != nil {
+				t.Fatalf("ParseExtendedHandshake() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.handshake) {
+				t.Errorf("ParseExtendedHandshake() got = %+v, want %+v", got, tt.handshake)
+			}
+		})
+	}
+}
+
+func TestPeerUpdateHandshake(t *testing.T) {
+	peer := &Peer{}
+	peer.updateHandshake(ExtendedHandshake{M: map[string]uint8{"ut_metadata": 3, "ut_pex": 4}, MetadataSize: 100})
+	peer.updateHandshake(ExtendedHandshake{M: map[string]uint8{"ut_pex": 0}, V: "client"})
+
+	got, ok := peer.ExtendedHandshake()
+	want := ExtendedHandshake{M: map[string]uint8{"ut_metadata": 3}, V: "client", MetadataSize: 100}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtendedHandshake() got = %+v, want %+v", got, want)
+	}
+	if peer.SupportsExtension("ut_pex") {
+		t.Errorf("SupportsExtension(ut_pex) got = true, want false")
+	}
+}
+
+func TestExtensionsRegister(t *testing.T) {
+	extensions := NewExtensions()
+	for _, name := range []string{"a", "b"} {
+		if err := extensions.Register(&testExtension{name: name}); err != nil {
+			t.Fatalf("Register(%s) error = %v", name, err)
+		}
+	}
+	if err := extensions.Register(&testExtension{name: "a"}); err == nil {
+		t.Errorf("Register(a) expected an error for a duplicate")
+	}
+
+	if want := map[string]uint8{"a": 1, "b": 2}; !reflect.DeepEqual(extensions.ids(), want) {
+		t.Errorf("ids() got = %v, want %v", extensions.ids(), want)
+	}
+	if ext := extensions.get(2); ext == nil || ext.Name() != "b" {
+		t.Errorf("get(2) got = %v, want b", ext)
+	}
+	if ext := extensions.get(0); ext != nil {
+		t.Errorf("get(0) got = %v, want nil", ext)
+	}
+}
+
+func TestHandshakeMessageReserved(t *testing.T) {
+	msg := handshakeMessage{pstr: pstr, reserved: localReserved()}
+	msg.reserved[dhtReservedByte] |= dhtReservedBit
+
+	got, err := readHandshakeMessage(bytes.NewReader(prepareHandshakeMessage(msg)))
+	if err != nil {
+		t.Fatalf("readHandshakeMessage() error = %v", err)
+	}
+	if !reflect.DeepEqual(*got, msg) {
+		t.Errorf("readHandshakeMessage() got = %+v, want %+v", *got, msg)
+	}
+	if !got.reserved.SupportsExtensions() || !got.reserved.SupportsDHT() || got.reserved.SupportsFast() {
+		t.Errorf("reserved got = %08b", got.reserved)
+	}
+}
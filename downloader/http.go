@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamHandler serves the files of the torrents in the session at /<info hash>/<file index>.
+// Range requests are supported, so players can seek, and the requested pieces are downloaded first.
+func (d *TorrentDownloader) StreamHandler() http.Handler {
+	return http.HandlerFunc(d.serveStream)
+}
+
+func (d *TorrentDownloader) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infoHash, file, err := parseStreamPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := d.torrent(infoHash)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// a magnet torrent knows its files once the metadata is received
+	select {
+	case <-t.metadataReady:
+	case <-r.Context().Done():
+		return
+	}
+	files := t.Files()
+	if file >= len(files) {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := t.NewReader(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = reader.Close() }()
+
+	// a blocked read returns once the client goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			_ = reader.Close()
+		case <-done:
+		}
+	}()
+
+	path := files[file].Path
+	http.ServeContent(w, r, path[len(path)-1], time.Time{}, reader)
+}
+
+// parseStreamPath parses /<hex info hash>/<file index>.
+func parseStreamPath(path string) ([20]byte, int, error) {
+	var infoHash [20]byte
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 {
+		return infoHash, 0, fmt.Errorf("expected /<info hash>/<file index>")
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || len(raw) != len(infoHash) {
+		return infoHash, 0, fmt.Errorf("invalid info hash %q", parts[0])
+	}
+	copy(infoHash[:], raw)
+	file, err := strconv.Atoi(parts[1])
+	if err != nil || file < 0 {
+		return infoHash, 0, fmt.Errorf("invalid file index %q", parts[1])
+	}
+	return infoHash, file, nil
+}
@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+const (
+	stateIdle torrentState = iota // created, not started yet
+	stateRunning
+	statePaused
+	stateStopped // final, the storage is closed
+)
+
+// ErrTorrentStopped is returned when a stopped torrent is started or downloaded.
+var ErrTorrentStopped = errors.New("torrent is stopped")
+
+// errHaltTimeout is returned by halt when the goroutines of the torrent didn't end in time.
+var errHaltTimeout = errors.New("failed to wait for the goroutines of the torrent")
+
+type (
+	torrentState int
+
+	// run is the stretch of a torrent between Start or Resume and Pause or Stop,
+	// every goroutine of the torrent belongs to a run and exits once its context is done.
+	run struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+		errs   chan error // the error that ended the download, e.g. a failed write
+	}
+)
+
+func newRun() *run {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &run{ctx: ctx, cancel: cancel, errs: make(chan error, 1)}
+}
+
+// spawn runs f in a goroutine that is waited for when the run ends.
+func (r *run) spawn(f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// fail records the error that ended the download, only the first one is kept.
+func (r *run) fail(err error) {
+	select {
+	case r.errs <- err:
+	default:
+	}
+}
+
+// Start connects to peers, announces the torrent and downloads the missing pieces in the background.
+// The torrent seeds once it is complete, until it is paused or stopped.
+func (t *Torrent) Start() error {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	switch t.state {
+	case stateRunning:
+		return nil
+	case stateStopped:
+		return ErrTorrentStopped
+	}
+	t.start()
+	return nil
+}
+
+// Resume starts a paused torrent again.
+func (t *Torrent) Resume() error {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	if t.state != statePaused {
+		return fmt.Errorf("torrent is not paused")
+	}
+	t.start()
+	return nil
+}
+
+// Pause disconnects the peers, tells the trackers we left and flushes the storage.
+// The verified pieces are kept, Resume continues from them. The context bounds the wait for the goroutines
+// of the torrent and the stopped announce.
+func (t *Torrent) Pause(ctx context.Context) error {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	if t.state != stateRunning {
+		return nil
+	}
+	// the torrent stays running until its goroutines are gone, so Pause or Stop can be called again
+	err := t.halt(ctx)
+	if errors.Is(err, errHaltTimeout) {
+		return err
+	}
+	t.state = statePaused
+	return err
+}
+
+// Stop pauses the torrent and closes its storage, a stopped torrent cannot be started again.
+// If the goroutines of the torrent don't end before the context is done, the error is returned and the torrent
+// is left as it is, so the storage isn't closed under a late write and Stop can be called again.
+func (t *Torrent) Stop(ctx context.Context) error {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	if t.state == stateStopped {
+		return nil
+	}
+	var err error
+	if t.state == stateRunning {
+		if err = t.halt(ctx); errors.Is(err, errHaltTimeout) {
+			return err
+		}
+	}
+	t.state = stateStopped
+	close(t.stopped)
+
+	// streaming readers waiting for pieces give up
+	t.completedMux.Lock()
+	t.verified.Broadcast()
+	t.completedMux.Unlock()
+
+	if t.storage != nil {
+		if closeErr := t.storage.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close storage: %w", closeErr)
+		}
+	}
+	return err
+}
+
+// Done returns a channel that is closed once every piece is verified.
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Torrent) isRunning() bool {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	return t.state == stateRunning
+}
+
+// addIncoming hands an accepted peer to the torrent, peers are only accepted while the torrent runs.
+func (t *Torrent) addIncoming(peer *Peer) error {
+	t.lifeMux.Lock()
+	defer t.lifeMux.Unlock()
+
+	if t.state != stateRunning {
+		return fmt.Errorf("torrent is not running")
+	}
+	return t.peers.addPeer(peer.ip, peer)
+}
+
+// start launches the goroutines of a new run, lifeMux must be held.
+func (t *Torrent) start() {
+	r := newRun()
+	t.run = r
+	t.state = stateRunning
+
+	r.spawn(func() { t.dispatchPeers(r) })
+	r.spawn(func() { t.runConnector(r) })
+	r.spawn(func() { t.runChoker(r.ctx.Done()) })
+	r.spawn(func() { t.runAnnouncer(r.ctx) })
+	r.spawn(func() { t.runDHTAnnouncer(r.ctx) })
+	r.spawn(func() { t.runWriter(r) })
+	t.connectToInitialPeers()
+}
+
+// halt ends the current run: the peers are disconnected, the goroutines are waited for,
+// the trackers learn we left and the storage is flushed. lifeMux must be held.
+func (t *Torrent) halt(ctx context.Context) error {
+	r := t.run
+	r.cancel()
+
+	// the outgoing peers are dialed again on resume, closing the connections unblocks pending writes
+	peers := t.peers.list()
+	for _, peer := range peers {
+		if peer.outgoing {
+			t.candidates.add([]model.PeerInfo{peer.Addr()})
+		}
+		_ = peer.Close()
+	}
+
+	if err := waitGroup(ctx, &r.wg); err != nil {
+		return fmt.Errorf("%w: %s", errHaltTimeout, err.Error())
+	}
+	t.dropPendingPeers()
+	t.announceExit(ctx)
+
+	if t.storage != nil {
+		if err := t.storage.Flush(); err != nil {
+			return fmt.Errorf("failed to flush storage: %w", err)
+		}
+	}
+	return nil
+}
+
+// dispatchPeers serves every connected peer in its own goroutine until the run ends.
+func (t *Torrent) dispatchPeers(r *run) {
+	for {
+		select {
+		case peer := <-t.peers.peersChan:
+			r.spawn(func() {
+				if err := t.download(r.ctx, peer); err != nil {
+					log.Printf("failed to download from peer, peerIP: %s, err: %s", peer.ip, err)
+				}
+			})
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// dropPendingPeers disconnects the peers that connected after the dispatcher exited.
+func (t *Torrent) dropPendingPeers() {
+	for {
+		select {
+		case peer := <-t.peers.peersChan:
+			_ = t.peers.removePeerIP(peer.ip)
+			_ = peer.Close()
+		default:
+			return
+		}
+	}
+}
+
+// runWriter writes the verified pieces to the storage until every piece is verified or the run ends.
+// The metadata of a magnet torrent is fetched from the peers first.
+func (t *Torrent) runWriter(r *run) {
+	select {
+	case <-t.metadataReady:
+	case <-r.ctx.Done():
+		return
+	}
+
+	lastFlush := time.Now()
+	for !t.isComplete() {
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-r.ctx.Done():
+			return
+		}
+		if err := t.storage.WriteBlock(res.index, 0, res.buf); err != nil {
+			r.fail(fmt.Errorf("failed to write piece #%d: %w", res.index, err))
+			return
+		}
+		if err := t.storage.MarkComplete(res.index); err != nil {
+			r.fail(fmt.Errorf("failed to mark piece #%d complete: %w", res.index, err))
+			return
+		}
+		t.markCompleted(res.index)
+
+		percent := float64(t.numCompleted()) / float64(len(t.torrentInfo.PieceHashes)) * 100
+		log.Printf("(%0.2f%%) downloaded piece #%d, torrent name: %s", percent, res.index, t.torrentInfo.Name)
+
+		if time.Since(lastFlush) > flushInterval {
+			if err := t.storage.Flush(); err != nil {
+				log.Printf("failed to flush storage, torrent name: %s, err: %s", t.torrentInfo.Name, err.Error())
+			}
+			lastFlush = time.Now()
+		}
+	}
+
+	if err := t.storage.Flush(); err != nil {
+		r.fail(fmt.Errorf("failed to flush storage: %w", err))
+		return
+	}
+	t.doneOnce.Do(func() { close(t.done) })
+}
+
+// waitGroup waits for the group until the context is done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,161 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+// newSession creates a session with a single torrent stored in store.
+func newSession(t *testing.T, peerID byte, torrentInfo model.TorrentInfo, store storage.Storage) (*TorrentDownloader, *Torrent) {
+	d, err := NewTorrentDownloader([20]byte{peerID}, nil, time.Second, WithPort(0))
+	if err != nil {
+		t.Fatalf("NewTorrentDownloader() error = %v", err)
+	}
+	torrent, err := NewTorrent(d.peerID, torrentInfo, time.Second, store)
+	if err != nil {
+		t.Fatalf("NewTorrent() error = %v", err)
+	}
+	d.add(torrent)
+	return d, torrent
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*blockSize/16+3)
+	torrentInfo := model.TorrentInfo{
+		InfoHash:    [20]byte{7},
+		PieceLength: 2 * blockSize,
+		Length:      int64(len(data)),
+		Name:        "swarm",
+	}
+	for begin := 0; begin < len(data); begin += 2 * blockSize {
+		end := begin + 2*blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		torrentInfo.PieceHashes = append(torrentInfo.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+
+	seedStore := storage.NewMemoryStorage(torrentInfo)
+	for index := range torrentInfo.PieceHashes {
+		begin := index * 2 * blockSize
+		end := begin + 2*blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := seedStore.WriteBlock(index, 0, data[begin:end]); err != nil {
+			t.Fatalf("WriteBlock() error = %v", err)
+		}
+		if err := seedStore.MarkComplete(index); err != nil {
+			t.Fatalf("MarkComplete() error = %v", err)
+		}
+	}
+	seeder, seedTorrent := newSession(t, 's', torrentInfo, seedStore)
+	if err := seeder.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	port := seeder.listener.Addr().(*net.TCPAddr).Port
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := seeder.Download(ctx); err != nil {
+		t.Fatalf("Download() of the seeder error = %v", err)
+	}
+
+	leechStore := storage.NewMemoryStorage(torrentInfo)
+	leecher, leechTorrent := newSession(t, 'l', torrentInfo, leechStore)
+	leechTorrent.initialPeers = []string{fmt.Sprintf("127.0.0.1:%d", port)}
+	if err := leecher.Download(ctx); err != nil {
+		t.Fatalf("Download() of the leecher error = %v", err)
+	}
+	for index := range torrentInfo.PieceHashes {
+		block, err := leechStore.ReadBlock(index, 0, leechTorrent.pieceLength(index))
+		if err != nil {
+			t.Fatalf("ReadBlock() error = %v", err)
+		}
+		if !bytes.Equal(block, data[index*2*blockSize:index*2*blockSize+len(block)]) {
+			t.Errorf("piece #%d differs from the seeded data", index)
+		}
+	}
+
+	// a paused torrent rejects peers until it is resumed
+	if err := seedTorrent.Pause(ctx); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+	if _, err := ConnectToPeer(ctx, tcp, "127.0.0.1", uint16(port), torrentInfo.InfoHash, [20]byte{'x'}); err == nil {
+		t.Errorf("ConnectToPeer() expected an error while the torrent is paused")
+	}
+	if err := seedTorrent.Resume(); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	peer, err := ConnectToPeer(ctx, tcp, "127.0.0.1", uint16(port), torrentInfo.InfoHash, [20]byte{'x'})
+	if err != nil {
+		t.Fatalf("ConnectToPeer() error = %v", err)
+	}
+	defer func() { _ = peer.Close() }()
+
+	for _, d := range []*TorrentDownloader{leecher, seeder} {
+		if err = d.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown() error = %v", err)
+		}
+	}
+	if seedTorrent.peers.count() != 0 {
+		t.Errorf("count() got = %d, want 0", seedTorrent.peers.count())
+	}
+	if err = seedTorrent.Download(ctx); !errors.Is(err, ErrTorrentStopped) {
+		t.Errorf("Download() error = %v, want %v", err, ErrTorrentStopped)
+	}
+	if _, err = net.Dial(tcp, fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Errorf("Dial() expected an error once the session is shut down")
+	}
+}
+
+// closeCounter counts the calls to Close of the storage.
+type closeCounter struct {
+	storage.Storage
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return c.Storage.Close()
+}
+
+func TestStopWaitsForGoroutines(t *testing.T) {
+	torrentInfo := model.TorrentInfo{InfoHash: [20]byte{8}, PieceHashes: [][20]byte{{1}}, PieceLength: blockSize, Length: blockSize, Name: "stop"}
+	store := &closeCounter{Storage: storage.NewMemoryStorage(torrentInfo)}
+	_, torrent := newSession(t, 's', torrentInfo, store)
+	if err := torrent.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	// a goroutine that outlives the context, like a peer stuck in a write
+	release := make(chan struct{})
+	torrent.lifeMux.Lock()
+	torrent.run.spawn(func() { <-release })
+	torrent.lifeMux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := torrent.Stop(ctx); err == nil {
+		t.Fatalf("Stop() error = nil, want the timeout")
+	}
+	if store.closed != 0 || !torrent.isRunning() {
+		t.Errorf("Stop() closed the storage %d times, running = %v, want it left as it is", store.closed, torrent.isRunning())
+	}
+
+	close(release)
+	if err := torrent.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if store.closed != 1 {
+		t.Errorf("Stop() closed the storage %d times, want 1", store.closed)
+	}
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	handshakeTimeout = 20 * time.Second
+	maxAcceptBackoff = time.Second
+)
+
+// serve accepts connections until the listener is closed, it backs off while accepting fails.
+func (d *TorrentDownloader) serve(listener net.Listener) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			log.Printf("failed to accept peer, retrying in %s, err: %s", backoff, err.Error())
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		d.serving.Add(1)
+		go func() {
+			defer d.serving.Done()
+			if err := d.accept(conn); err != nil {
+				log.Printf("rejected peer, addr: %s, err: %s", conn.RemoteAddr(), err.Error())
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// nextBackoff doubles the wait after a failed accept, from 5ms up to maxAcceptBackoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return 5 * time.Millisecond
+	}
+	if backoff *= 2; backoff > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return backoff
+}
+
+// accept answers the handshake of an incoming connection and hands the peer to the torrent it asks for.
+// Connections for unknown torrents are rejected before we reveal anything about us.
+func (d *TorrentDownloader) accept(conn net.Conn) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected address %s", conn.RemoteAddr())
+	}
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	handshake, err := readHandshakeMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read handshake message: %w", err)
+	}
+	if handshake.pstr != pstr {
+		return fmt.Errorf("unknown protocol %q", handshake.pstr)
+	}
+	if handshake.peerID == d.peerID {
+		return fmt.Errorf("connected to ourselves")
+	}
+	t := d.torrent(handshake.infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown info hash %x", handshake.infoHash)
+	}
+	if !t.isRunning() {
+		return fmt.Errorf("torrent is not running")
+	}
+	ip := addr.IP.String()
+	if t.peers.existPeerIP(ip) {
+		return fmt.Errorf("peer is already connected")
+	}
+
+	err = writeHandshakeMessage(conn, handshakeMessage{
+		pstr:     pstr,
+		reserved: localReserved(),
+		infoHash: handshake.infoHash,
+		peerID:   d.peerID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write handshake message: %w", err)
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	peer := &Peer{
+		conn:     conn,
+		ip:       ip,
+		port:     uint16(addr.Port),
+		reserved: handshake.reserved,
+		peerID:   handshake.peerID,
+		choked:   true,
+	}
+	return t.addIncoming(peer)
+}
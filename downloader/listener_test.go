@@ -0,0 +1,136 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+func newSeedingSession(t *testing.T, data []byte) (*TorrentDownloader, model.TorrentInfo, net.Listener) {
+	torrentInfo := model.TorrentInfo{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		PieceLength: int64(len(data)),
+		Length:      int64(len(data)),
+		Name:        "seed",
+	}
+	store := storage.NewMemoryStorage(torrentInfo)
+	if err := store.WriteBlock(0, 0, data); err != nil {
+		t.Fatalf("WriteBlock() error = %v", err)
+	}
+	if err := store.MarkComplete(0); err != nil {
+		t.Fatalf("MarkComplete() error = %v", err)
+	}
+
+	d, err := NewTorrentDownloader([20]byte{'s'}, nil, time.Second, WithStorage(func(model.TorrentInfo) (storage.Storage, error) {
+		return store, nil
+	}))
+	if err != nil {
+		t.Fatalf("NewTorrentDownloader() error = %v", err)
+	}
+	torrent, err := NewTorrent(d.peerID, torrentInfo, time.Second, store)
+	if err != nil {
+		t.Fatalf("NewTorrent() error = %v", err)
+	}
+	d.add(torrent)
+	if err = torrent.Download(context.Background()); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	listener, err := net.Listen(tcp, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go d.serve(listener)
+	return d, torrentInfo, listener
+}
+
+func TestListenerServesRequests(t *testing.T) {
+	data := []byte("some data to seed")
+	_, torrentInfo, listener := newSeedingSession(t, data)
+	defer func() { _ = listener.Close() }()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	peer, err := ConnectToPeer(context.Background(), tcp, "127.0.0.1", uint16(addr.Port), torrentInfo.InfoHash, [20]byte{'l'})
+	if err != nil {
+		t.Fatalf("ConnectToPeer() error = %v", err)
+	}
+	defer func() { _ = peer.Close() }()
+	if err = peer.conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetDeadline() error = %v", err)
+	}
+
+	if err = peer.WriteMessage(NewInterested()); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err = peer.WriteMessage(NewRequest(0, 5, 4)); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	var bitfield Bitfield
+	for {
+		msg, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case MsgBitfield:
+			bitfield, _ = ParseBitfield(msg)
+		case MsgPiece:
+			index, begin, block, err := ParsePiece(msg)
+			if err != nil || index != 0 || begin != 5 || !bytes.Equal(block, data[5:9]) {
+				t.Fatalf("ParsePiece() got = %d, %d, %q, %v", index, begin, block, err)
+			}
+			if !bitfield.HasPiece(0) {
+				t.Errorf("bitfield got = %08b, want the piece", bitfield)
+			}
+			return
+		}
+	}
+}
+
+func TestListenerRejectsUnknownInfoHash(t *testing.T) {
+	_, _, listener := newSeedingSession(t, []byte("data"))
+	defer func() { _ = listener.Close() }()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if _, err := ConnectToPeer(context.Background(), tcp, "127.0.0.1", uint16(addr.Port), [20]byte{9}, [20]byte{'l'}); err == nil {
+		t.Errorf("ConnectToPeer() expected an error for an unknown info hash")
+	}
+}
+
+func TestConnectToPeerDeadline(t *testing.T) {
+	listener, err := net.Listen(tcp, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		// accept the connection but never answer the handshake
+		conn, err := listener.Accept()
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	addr := listener.Addr().(*net.TCPAddr)
+	start := time.Now()
+	if _, err = ConnectToPeer(ctx, tcp, "127.0.0.1", uint16(addr.Port), [20]byte{1}, [20]byte{'l'}); err == nil {
+		t.Errorf("ConnectToPeer() expected an error for a silent peer")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ConnectToPeer() took %s", elapsed)
+	}
+}
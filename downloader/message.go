@@ -0,0 +1,280 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const maxMessageLength = 1 << 20 // 1 MiB, no valid message is larger than a block plus headers
+
+type messageID uint8
+
+const (
+	MsgChoke         messageID = 0
+	MsgUnchoke       messageID = 1
+	MsgInterested    messageID = 2
+	MsgNotInterested messageID = 3
+	MsgHave          messageID = 4
+	MsgBitfield      messageID = 5
+	MsgRequest       messageID = 6
+	MsgPiece         messageID = 7
+	MsgCancel        messageID = 8
+	MsgExtended      messageID = 20 // see http://bittorrent.org/beps/bep_0010.html
+)
+
+type (
+	// Message is a single peer wire message, a nil *Message is a keep-alive.
+	Message struct {
+		ID      messageID
+		Payload []byte
+	}
+
+	// Bitfield represents the pieces that a peer has.
+	Bitfield []byte
+)
+
+func (id messageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not-interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgExtended:
+		return "extended"
+	default:
+		return fmt.Sprintf("unknown#%d", uint8(id))
+	}
+}
+
+func (m *Message) String() string {
+	if m == nil {
+		return "keep-alive"
+	}
+	return fmt.Sprintf("%s [%d]", m.ID, len(m.Payload))
+}
+
+// Serialize encodes the message as <length prefix><message ID><payload>.
+func (m *Message) Serialize() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+	length := uint32(len(m.Payload) + 1)
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+// ReadMessage reads a single message from the stream, nil is returned for a keep-alive.
+func ReadMessage(r io.Reader) (*Message, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("message length %d exceeds limit %d", length, maxMessageLength)
+	}
+
+	messageBuf := make([]byte, length)
+	if _, err := io.ReadFull(r, messageBuf); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		ID:      messageID(messageBuf[0]),
+		Payload: messageBuf[1:],
+	}, nil
+}
+
+func NewChoke() *Message {
+	return &Message{ID: MsgChoke}
+}
+
+func NewUnchoke() *Message {
+	return &Message{ID: MsgUnchoke}
+}
+
+func NewInterested() *Message {
+	return &Message{ID: MsgInterested}
+}
+
+func NewNotInterested() *Message {
+	return &Message{ID: MsgNotInterested}
+}
+
+func NewHave(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: MsgHave, Payload: payload}
+}
+
+func NewBitfield(bitfield Bitfield) *Message {
+	payload := make([]byte, len(bitfield))
+	copy(payload, bitfield)
+	return &Message{ID: MsgBitfield, Payload: payload}
+}
+
+func NewRequest(index, begin, length int) *Message {
+	return &Message{ID: MsgRequest, Payload: blockPayload(index, begin, length)}
+}
+
+func NewPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func NewCancel(index, begin, length int) *Message {
+	return &Message{ID: MsgCancel, Payload: blockPayload(index, begin, length)}
+}
+
+// NewExtended wraps the payload of an extension message, id is the extended message ID assigned by the receiver.
+func NewExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+func blockPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+// ParseHave returns the piece index announced by a have message.
+func ParseHave(msg *Message) (int, error) {
+	if err := expectID(msg, MsgHave); err != nil {
+		return 0, err
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// ParseBitfield returns the bitfield carried by a bitfield message.
+func ParseBitfield(msg *Message) (Bitfield, error) {
+	if err := expectID(msg, MsgBitfield); err != nil {
+		return nil, err
+	}
+	bitfield := make(Bitfield, len(msg.Payload))
+	copy(bitfield, msg.Payload)
+	return bitfield, nil
+}
+
+// ParseRequest returns index, begin and length of a request or cancel message.
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg == nil || (msg.ID != MsgRequest && msg.ID != MsgCancel) {
+		return 0, 0, 0, fmt.Errorf("expected request or cancel, got %s", msg)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParsePiece returns index, begin and the block data of a piece message.
+func ParsePiece(msg *Message) (index, begin int, block []byte, err error) {
+	if err = expectID(msg, MsgPiece); err != nil {
+		return 0, 0, nil, err
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short, length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// ParseExtended returns the extended message ID and the payload of an extended message.
+func ParseExtended(msg *Message) (id uint8, payload []byte, err error) {
+	if err = expectID(msg, MsgExtended); err != nil {
+		return 0, nil, err
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("payload is empty")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func expectID(msg *Message, id messageID) error {
+	if msg == nil {
+		return fmt.Errorf("expected %s, got keep-alive", id)
+	}
+	if msg.ID != id {
+		return fmt.Errorf("expected %s, got %s", id, msg.ID)
+	}
+	return nil
+}
+
+// NewBitfieldOfSize returns an empty bitfield able to hold n pieces.
+func NewBitfieldOfSize(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// check returns an error unless the bitfield has the length for n pieces and no spare bits set.
+func (bf Bitfield) check(n int) error {
+	if want := (n + 7) / 8; len(bf) != want {
+		return fmt.Errorf("expected bitfield length %d, got length %d", want, len(bf))
+	}
+	if n%8 != 0 && bf[len(bf)-1]&(0xFF>>(n%8)) != 0 {
+		return fmt.Errorf("spare bits of the bitfield are set")
+	}
+	return nil
+}
+
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-offset)&1 != 0
+}
+
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - offset)
+}
+
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - offset)
+}
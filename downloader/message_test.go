@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	type args struct {
+		r io.Reader
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *Message
+		wantErr bool
+	}{
+		{
+			name: "have",
+			args: args{r: bytes.NewReader([]byte{0, 0, 0, 5, 4, 0, 0, 0, 7})},
+			want: &Message{ID: MsgHave, Payload: []byte{0, 0, 0, 7}},
+		},
+		{
+			name: "keep-alive",
+			args: args{r: bytes.NewReader([]byte{0, 0, 0, 0})},
+			want: nil,
+		},
+		{
+			name:    "truncated",
+			args:    args{r: bytes.NewReader([]byte{0, 0, 0, 5, 4, 0})},
+			wantErr: true,
+		},
+		{
+			name:    "too long",
+			args:    args{r: bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMessage(tt.args.r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadMessage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadMessage() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg, err := ReadMessage(bytes.NewReader(NewRequest(3, 16384, 16384).Serialize()))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	index, begin, length, err := ParseRequest(msg)
+	if err != nil {
+		t.Fatalf("ParseRequest() error = %v", err)
+	}
+	if index != 3 || begin != 16384 || length != 16384 {
+		t.Errorf("ParseRequest() got = %d, %d, %d", index, begin, length)
+	}
+
+	msg, err = ReadMessage(bytes.NewReader(NewPiece(1, 2, []byte("block")).Serialize()))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	index, begin, block, err := ParsePiece(msg)
+	if err != nil {
+		t.Fatalf("ParsePiece() error = %v", err)
+	}
+	if index != 1 || begin != 2 || string(block) != "block" {
+		t.Errorf("ParsePiece() got = %d, %d, %q", index, begin, block)
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfieldOfSize(10)
+	bf.SetPiece(0)
+	bf.SetPiece(9)
+	if !reflect.DeepEqual(bf, Bitfield{0x80, 0x40}) {
+		t.Errorf("SetPiece() got = %08b", bf)
+	}
+	for i := 0; i < 10; i++ {
+		if want := i == 0 || i == 9; bf.HasPiece(i) != want {
+			t.Errorf("HasPiece(%d) got = %v, want %v", i, !want, want)
+		}
+	}
+	if bf.HasPiece(100) {
+		t.Errorf("HasPiece(100) got = true, want false")
+	}
+}
+
+func TestBitfieldCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		bf      Bitfield
+		n       int
+		wantErr bool
+	}{
+		{name: "exact", bf: Bitfield{0xFF, 0xC0}, n: 10},
+		{name: "full bytes", bf: Bitfield{0xFF}, n: 8},
+		{name: "short", bf: Bitfield{0xFF}, n: 10, wantErr: true},
+		{name: "long", bf: Bitfield{0xFF, 0x00, 0x00}, n: 10, wantErr: true},
+		{name: "spare bits", bf: Bitfield{0xFF, 0xE0}, n: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.bf.check(tt.n); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
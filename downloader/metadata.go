@@ -0,0 +1,272 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// Metadata exchange, see http://bittorrent.org/beps/bep_0009.html
+const (
+	utMetadata = "ut_metadata"
+
+	metadataPieceSize = 16384
+	maxMetadataSize   = 16 << 20                    // 16 MiB, more than any sane info dictionary
+	maxPieces         = maxMetadataSize / sha1.Size // the most pieces an info dictionary of the largest size can hold
+
+	metadataRequestTimeout = 10 * time.Second // a piece not received in time is requested from the next peer
+	metadataRejectBackoff  = time.Minute      // a peer that rejected a request isn't asked again for a while
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type (
+	// metadataExchange assembles the info dictionary from the pieces sent by peers.
+	metadataExchange struct {
+		infoHash [20]byte
+
+		mux       sync.Mutex
+		size      int
+		pieces    [][]byte
+		requested []time.Time // when the pieces were last requested, zero if they are free to request
+		done      bool
+	}
+
+	// metadataState is the exchange with a single peer.
+	metadataState struct {
+		rejected time.Time
+	}
+
+	// metadataExtension is the ut_metadata extension of the torrent.
+	metadataExtension struct {
+		t *Torrent
+	}
+)
+
+func newMetadataExchange(infoHash [20]byte) *metadataExchange {
+	return &metadataExchange{infoHash: infoHash}
+}
+
+// request returns the missing pieces that are not requested from another peer lately and marks them requested.
+// The size reported by a peer is used until the metadata of that size turns out to be wrong, peers that report
+// another size are not asked meanwhile.
+func (m *metadataExchange) request(size int, now time.Time) []int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.done {
+		return nil
+	}
+	if m.size == 0 {
+		m.size = size
+		m.pieces = make([][]byte, (size+metadataPieceSize-1)/metadataPieceSize)
+		m.requested = make([]time.Time, len(m.pieces))
+	}
+	if m.size != size {
+		return nil
+	}
+
+	missing := make([]int, 0, len(m.pieces))
+	for index, piece := range m.pieces {
+		if piece == nil && now.Sub(m.requested[index]) >= metadataRequestTimeout {
+			m.requested[index] = now
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// release makes the piece free to request from another peer.
+func (m *metadataExchange) release(index int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if index >= 0 && index < len(m.requested) {
+		m.requested[index] = time.Time{}
+	}
+}
+
+// put stores the piece and returns the whole info dictionary once it is complete and matches the info hash.
+func (m *metadataExchange) put(index int, data []byte) ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.done || index < 0 || index >= len(m.pieces) || m.pieces[index] != nil {
+		return nil, nil
+	}
+	if expected := m.pieceLength(index); len(data) != expected {
+		// the peers disagree on the size, the next reported one is tried
+		m.forget()
+		return nil, fmt.Errorf("metadata piece #%d has length %d, expected %d", index, len(data), expected)
+	}
+	m.pieces[index] = append([]byte(nil), data...)
+
+	for _, piece := range m.pieces {
+		if piece == nil {
+			return nil, nil
+		}
+	}
+
+	rawInfo := bytes.Join(m.pieces, nil)
+	if hash := sha1.Sum(rawInfo); hash != m.infoHash {
+		// there is no way to tell which peer lied, start over with the size the next peer reports
+		m.forget()
+		return nil, fmt.Errorf("metadata doesn't match the info hash")
+	}
+	m.done = true
+	return rawInfo, nil
+}
+
+// reset forgets the received pieces, it is used when the complete metadata turned out to be unusable.
+func (m *metadataExchange) reset() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.forget()
+	m.done = false
+}
+
+// forget drops the size and the received pieces, m.mux must be held.
+func (m *metadataExchange) forget() {
+	m.size = 0
+	m.pieces = nil
+	m.requested = nil
+}
+
+func (m *metadataExchange) pieceLength(index int) int {
+	if index == len(m.pieces)-1 {
+		return m.size - index*metadataPieceSize
+	}
+	return metadataPieceSize
+}
+
+func (e *metadataExtension) Name() string {
+	return utMetadata
+}
+
+// OnHandshake requests the metadata from the peer unless it is known already.
+func (e *metadataExtension) OnHandshake(peer *Peer) error {
+	if e.t.hasMetadata() {
+		return nil
+	}
+	return e.t.requestMetadata(peer)
+}
+
+// Tick requests the pieces that were rejected, timed out or dropped after a failed hash check.
+// Peers that rejected a request lately are left out, so the requests go to the other peers.
+func (e *metadataExtension) Tick(peer *Peer) error {
+	if e.t.hasMetadata() || time.Since(peer.metadata.rejected) < metadataRejectBackoff {
+		return nil
+	}
+	return e.t.requestMetadata(peer)
+}
+
+func (e *metadataExtension) HandleMessage(peer *Peer, payload []byte) error {
+	return e.t.handleMetadataMessage(peer, payload)
+}
+
+// requestMetadata asks the peer for the metadata pieces that are missing and not requested from another peer.
+func (t *Torrent) requestMetadata(peer *Peer) error {
+	handshake, _ := peer.ExtendedHandshake()
+	if handshake.MetadataSize <= 0 || handshake.MetadataSize > maxMetadataSize {
+		return nil
+	}
+
+	for _, index := range t.metadata.request(handshake.MetadataSize, time.Now()) {
+		payload, err := bencode.Encode(map[string]interface{}{
+			"msg_type": metadataRequest,
+			"piece":    index,
+		})
+		if err != nil {
+			return err
+		}
+		if err = peer.WriteExtended(utMetadata, payload); err != nil {
+			return fmt.Errorf("failed to request metadata piece: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *Torrent) handleMetadataMessage(peer *Peer, payload []byte) error {
+	value, n, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode ut_metadata message: %w", err)
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("ut_metadata message is not a dictionary")
+	}
+	msgType, ok := dict["msg_type"].(int64)
+	if !ok {
+		return nil // junk isn't mistaken for a request
+	}
+	piece, ok := dict["piece"].(int64)
+	if !ok {
+		return nil // every message type names the piece
+	}
+
+	switch msgType {
+	case metadataRequest:
+		return t.serveMetadata(peer, int(piece))
+	case metadataData:
+		rawInfo, err := t.metadata.put(int(piece), payload[n:])
+		if err != nil {
+			log.Printf("failed to receive metadata from peer, peerIP: %s, err: %s", peer.ip, err.Error())
+			return nil
+		}
+		if rawInfo == nil {
+			return nil
+		}
+		if err = t.setMetadata(rawInfo); err != nil {
+			t.metadata.reset()
+			return err
+		}
+		return nil
+	case metadataReject:
+		peer.metadata.rejected = time.Now()
+		t.metadata.release(int(piece))
+		return nil
+	default:
+		return nil // unknown message types must be ignored
+	}
+}
+
+// serveMetadata sends the requested metadata piece, or rejects the request if the metadata isn't known yet.
+func (t *Torrent) serveMetadata(peer *Peer, index int) error {
+	var rawInfo []byte
+	if t.hasMetadata() {
+		rawInfo = t.info().RawInfo
+	}
+	begin := index * metadataPieceSize
+	if rawInfo == nil || index < 0 || begin >= len(rawInfo) {
+		payload, err := bencode.Encode(map[string]interface{}{
+			"msg_type": metadataReject,
+			"piece":    index,
+		})
+		if err != nil {
+			return err
+		}
+		return peer.WriteExtended(utMetadata, payload)
+	}
+
+	end := begin + metadataPieceSize
+	if end > len(rawInfo) {
+		end = len(rawInfo)
+	}
+	payload, err := bencode.Encode(map[string]interface{}{
+		"msg_type":   metadataData,
+		"piece":      index,
+		"total_size": len(rawInfo),
+	})
+	if err != nil {
+		return err
+	}
+	return peer.WriteExtended(utMetadata, append(payload, rawInfo[begin:end]...))
+}
@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+func TestMetadataExchange(t *testing.T) {
+	rawInfo := bytes.Repeat([]byte{'i'}, metadataPieceSize+10)
+	m := newMetadataExchange(sha1.Sum(rawInfo))
+	now := time.Now()
+
+	// a lying peer reports the size first
+	if got := m.request(20, now); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("request() got = %v, want [0]", got)
+	}
+	if got := m.request(len(rawInfo), now); len(got) != 0 {
+		t.Errorf("request() of another size got = %v, want none", got)
+	}
+	if _, err := m.put(0, rawInfo[:metadataPieceSize]); err == nil {
+		t.Fatalf("put() of a piece of another size error = nil, want an error")
+	}
+
+	// the size is dropped, so the next peer's size is used
+	if got := m.request(len(rawInfo), now); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Fatalf("request() got = %v, want [0 1]", got)
+	}
+	if got := m.request(len(rawInfo), now); len(got) != 0 {
+		t.Errorf("request() of requested pieces got = %v, want none", got)
+	}
+
+	// rejected and timed out pieces go to the next peer
+	m.release(1)
+	if got := m.request(len(rawInfo), now); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("request() after release got = %v, want [1]", got)
+	}
+	if got := m.request(len(rawInfo), now.Add(metadataRequestTimeout)); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("request() after the timeout got = %v, want [0 1]", got)
+	}
+
+	if got, err := m.put(0, rawInfo[:metadataPieceSize]); err != nil || got != nil {
+		t.Fatalf("put() got = %v, %v, want nil, nil", got, err)
+	}
+	got, err := m.put(1, rawInfo[metadataPieceSize:])
+	if err != nil || !bytes.Equal(got, rawInfo) {
+		t.Errorf("put() got = %v, %v, want the info dictionary", len(got), err)
+	}
+	if got := m.request(len(rawInfo), now); len(got) != 0 {
+		t.Errorf("request() when done got = %v, want none", got)
+	}
+}
+
+// countingConn counts the writes to it.
+type countingConn struct {
+	discardConn
+	writes *int
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	*c.writes++
+	return len(b), nil
+}
+
+func TestHandleMetadataMessageDropsJunk(t *testing.T) {
+	torrentInfo := model.TorrentInfo{
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{{1}},
+		PieceLength: blockSize,
+		Length:      blockSize,
+		Name:        "metadata",
+		RawInfo:     []byte("d4:name8:metadatae"),
+	}
+	torrent, err := NewTorrent([20]byte{'a'}, torrentInfo, time.Second, storage.NewMemoryStorage(torrentInfo))
+	if err != nil {
+		t.Fatalf("NewTorrent() error = %v", err)
+	}
+	writes := 0
+	peer := &Peer{conn: countingConn{writes: &writes}}
+	peer.updateHandshake(ExtendedHandshake{M: map[string]uint8{utMetadata: 3}})
+
+	tests := []struct {
+		name       string
+		payload    string
+		wantWrites int
+	}{
+		{name: "missing msg_type", payload: "d5:piecei0ee"},
+		{name: "msg_type is not an integer", payload: "d8:msg_type1:05:piecei0ee"},
+		{name: "missing piece", payload: "d8:msg_typei0ee"},
+		{name: "request", payload: "d8:msg_typei0e5:piecei0ee", wantWrites: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writes = 0
+			if err := torrent.handleMetadataMessage(peer, []byte(tt.payload)); err != nil {
+				t.Fatalf("handleMetadataMessage() error = %v", err)
+			}
+			if writes != tt.wantWrites {
+				t.Errorf("handleMetadataMessage() wrote %d messages, want %d", writes, tt.wantWrites)
+			}
+		})
+	}
+}
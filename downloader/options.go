@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/dht"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+const defaultDownloadDir = "."
+
+type (
+	Option func(*options)
+
+	options struct {
+		storage storage.Factory
+		dht     *dht.DHT
+		port    uint16
+		slots   int
+		picker  PickerFactory
+	}
+)
+
+func defaultOptions() options {
+	return options{
+		storage: storage.NewFileStorageFactory(defaultDownloadDir),
+		port:    client.DefaultPort,
+		slots:   defaultUploadSlots,
+		picker:  NewRarestFirstPicker,
+	}
+}
+
+// WithStorage sets the backend that verified pieces are written to, files in the working directory are used by default.
+func WithStorage(factory storage.Factory) Option {
+	return func(o *options) {
+		o.storage = factory
+	}
+}
+
+// WithDHT makes torrents look for peers in the DHT as well as on their trackers, private torrents never use it.
+func WithDHT(d *dht.DHT) Option {
+	return func(o *options) {
+		o.dht = d
+	}
+}
+
+// WithPort sets the port Listen accepts peers on and the torrents announce, 6881 by default.
+func WithPort(port uint16) Option {
+	return func(o *options) {
+		o.port = port
+	}
+}
+
+// WithUploadSlots sets how many peers are unchoked for their rates, one more peer is unchoked optimistically.
+// NewTorrentDownloader rejects less than one slot.
+func WithUploadSlots(slots int) Option {
+	return func(o *options) {
+		o.slots = slots
+	}
+}
+
+// WithPicker sets the strategy that picks the pieces to download, the rarest pieces are picked first by default.
+func WithPicker(factory PickerFactory) Option {
+	return func(o *options) {
+		o.picker = factory
+	}
+}
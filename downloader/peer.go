@@ -2,91 +2,176 @@ package downloader
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
 )
 
-const pstr = "BitTorrent protocol"
+const (
+	pstr         = "BitTorrent protocol"
+	readTimeout  = 3 * time.Minute  // keep-alives are expected every two minutes
+	writeTimeout = 30 * time.Second // a peer that doesn't read its socket for that long is dropped
+)
+
+// Bits of the reserved handshake bytes that announce protocol extensions.
+const (
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10 // see http://bittorrent.org/beps/bep_0010.html
+	dhtReservedByte       = 7
+	dhtReservedBit        = 0x01 // see http://bittorrent.org/beps/bep_0005.html
+	fastReservedByte      = 7
+	fastReservedBit       = 0x04 // see http://bittorrent.org/beps/bep_0006.html
+)
 
 type (
 	Peers struct {
-		peerIPs   []string
+		peers     map[string]*Peer // connected peers by IP
 		mux       sync.Mutex
 		peersChan chan *Peer
+
+		choker choker // used by the goroutine that runs the choker and by unchokeIfFree
 	}
 
 	Peer struct {
-		conn net.Conn
-		ip   string
+		// accessed atomically, kept first for 64-bit alignment
+		downloaded int64 // bytes of blocks the peer sent us
+		uploaded   int64 // bytes of blocks we sent the peer
+		unchoked   int32 // 1 if we allow the peer to request pieces from us
+		interested int32 // 1 if the peer wants pieces from us
+
+		conn     net.Conn
+		ip       string
+		port     uint16
+		outgoing bool // we connected to the peer, so it accepts connections
+		writeMux sync.Mutex
+
+		reserved Reserved
+		peerID   [20]byte
+
+		// owned by the goroutine that serves the peer
+		choked       bool               // the peer chokes us
+		amInterested bool               // we told the peer we want pieces from it
+		bitfield     Bitfield           // the pieces the peer has
+		counted      bool               // the bitfield is counted in the availability of the pieces
+		announced    Bitfield           // the pieces we told the peer we have
+		handshake    *ExtendedHandshake // nil until the peer sends its extended handshake
+		pex          pexState
+		metadata     metadataState
 	}
 
+	// Reserved are the reserved bytes of the handshake, peers set bits in them to announce the extensions they support.
+	Reserved [8]byte
+
 	handshakeMessage struct {
 		pstr     string
+		reserved Reserved
 		infoHash [20]byte
 		peerID   [20]byte
 	}
 )
 
-func ConnectToPeer(network, ip string, port uint16, infoHash, peerID [20]byte) (*Peer, error) {
-	address := fmt.Sprintf("%s:%d", ip, port)
-	log.Printf("resolving TCP, network: %s, address: %s", network, address)
-	addr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+// ConnectToPeer dials the peer and exchanges handshakes, the deadline of the context applies to both.
+func ConnectToPeer(ctx context.Context, network, ip string, port uint16, infoHash, peerID [20]byte) (*Peer, error) {
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
 	log.Printf("dialing TCP, network: %s, address: %s", network, address)
-	conn, err := net.DialTCP(network, nil, addr)
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial with timeout: %w", err)
+		return nil, fmt.Errorf("failed to dial: %w", err)
 	}
 
 	log.Printf("handshaking with Peer, network: %s, address: %s", network, address)
-	if err = doHandshake(conn, infoHash, peerID); err != nil {
+	handshake, err := doHandshake(ctx, conn, infoHash, peerID)
+	if err != nil {
+		_ = conn.Close()
 		return nil, fmt.Errorf("failed to do handshake: %w", err)
 	}
 
 	return &Peer{
-		conn: conn,
-		ip:   ip,
+		conn:     conn,
+		ip:       ip,
+		port:     port,
+		outgoing: true,
+		reserved: handshake.reserved,
+		peerID:   handshake.peerID,
+		choked:   true,
 	}, nil
 }
 
-func doHandshake(conn *net.TCPConn, infoHash, peerID [20]byte) error {
+// localReserved returns the reserved bytes we send, announcing the extensions we support.
+func localReserved() Reserved {
+	var reserved Reserved
+	reserved[extensionReservedByte] |= extensionReservedBit
+	return reserved
+}
+
+func doHandshake(ctx context.Context, conn net.Conn, infoHash, peerID [20]byte) (*handshakeMessage, error) {
+	release := bindDeadline(ctx, conn)
+	defer release()
+
 	expected := handshakeMessage{
 		pstr:     pstr,
+		reserved: localReserved(),
 		infoHash: infoHash,
 		peerID:   peerID,
 	}
 
 	if err := writeHandshakeMessage(conn, expected); err != nil {
-		return fmt.Errorf("failed to write handshake message: %w", err)
+		return nil, fmt.Errorf("failed to write handshake message: %w", err)
 	}
 
 	actual, err := readHandshakeMessage(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read handshake message: %w", err)
+		return nil, fmt.Errorf("failed to read handshake message: %w", err)
 	}
 
 	if !bytes.Equal(actual.infoHash[:], infoHash[:]) {
-		return errors.New("infoHash's are not equal")
+		return nil, errors.New("infoHash's are not equal")
 	}
 
-	return nil
+	return actual, nil
+}
+
+// bindDeadline applies the deadline of the context to the connection and interrupts pending I/O once the context is done.
+// The returned func clears the deadline.
+func bindDeadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0)) // in the past, fails pending reads and writes
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		_ = conn.SetDeadline(time.Time{})
+	}
 }
 
-func writeHandshakeMessage(conn *net.TCPConn, msg handshakeMessage) error {
-	_, err := conn.Write(prepareHandshakeMessage(msg))
+func writeHandshakeMessage(w io.Writer, msg handshakeMessage) error {
+	_, err := w.Write(prepareHandshakeMessage(msg))
 	return err
 }
 
-func readHandshakeMessage(conn *net.TCPConn) (*handshakeMessage, error) {
+func readHandshakeMessage(r io.Reader) (*handshakeMessage, error) {
 	lengthBuf := make([]byte, 1)
-	_, err := io.ReadFull(conn, lengthBuf)
+	_, err := io.ReadFull(r, lengthBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -98,28 +183,32 @@ func readHandshakeMessage(conn *net.TCPConn) (*handshakeMessage, error) {
 	}
 
 	handshakeBuf := make([]byte, pstrLen+48)
-	_, err = io.ReadFull(conn, handshakeBuf)
+	_, err = io.ReadFull(r, handshakeBuf)
 	if err != nil {
 		return nil, err
 	}
 
+	var reserved Reserved
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+28])
 	copy(peerID[:], handshakeBuf[pstrLen+28:])
 
 	return &handshakeMessage{
 		pstr:     string(handshakeBuf[0:pstrLen]),
+		reserved: reserved,
 		infoHash: infoHash,
 		peerID:   peerID,
 	}, nil
 }
+
 func prepareHandshakeMessage(msg handshakeMessage) []byte {
 	buf := make([]byte, len(msg.pstr)+49)
 	buf[0] = byte(len(msg.pstr))
 	offset := 1
 	offset += copy(buf[offset:], msg.pstr)
-	offset += copy(buf[offset:], make([]byte, 8)) // 8 reserved bytes
+	offset += copy(buf[offset:], msg.reserved[:])
 	offset += copy(buf[offset:], msg.infoHash[:])
 	offset += copy(buf[offset:], msg.peerID[:])
 	return buf
@@ -129,14 +218,12 @@ func (p *Peers) addPeer(peerIP string, peer *Peer) error {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
-	for _, k := range p.peerIPs {
-		if k == peerIP {
-			return fmt.Errorf("peer is already exist with peerIP: %s", peerIP)
-		}
+	if _, ok := p.peers[peerIP]; ok {
+		return fmt.Errorf("peer is already exist with peerIP: %s", peerIP)
 	}
 
 	p.peersChan <- peer
-	p.peerIPs = append(p.peerIPs, peerIP)
+	p.peers[peerIP] = peer
 	return nil
 }
 
@@ -144,25 +231,113 @@ func (p *Peers) removePeerIP(peerIP string) error {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
-	for index, ip := range p.peerIPs {
-		if ip == peerIP {
-			p.peerIPs = append(p.peerIPs[:index], p.peerIPs[index+1:]...)
-			return nil
-		}
+	if _, ok := p.peers[peerIP]; !ok {
+		return fmt.Errorf("peerIP is not presented in peers")
 	}
-
-	return fmt.Errorf("peerIP is not presented in peerIPs")
+	delete(p.peers, peerIP)
+	return nil
 }
 
 func (p *Peers) existPeerIP(peerIP string) bool {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
-	for _, ip := range p.peerIPs {
-		if ip == peerIP {
-			return true
+	_, ok := p.peers[peerIP]
+	return ok
+}
+
+// SupportsExtensions reports whether the peer supports the extension protocol.
+func (r Reserved) SupportsExtensions() bool {
+	return r[extensionReservedByte]&extensionReservedBit != 0
+}
+
+// SupportsDHT reports whether the peer runs a DHT node.
+func (r Reserved) SupportsDHT() bool {
+	return r[dhtReservedByte]&dhtReservedBit != 0
+}
+
+// SupportsFast reports whether the peer supports the fast extension.
+func (r Reserved) SupportsFast() bool {
+	return r[fastReservedByte]&fastReservedBit != 0
+}
+
+// Reserved returns the reserved bytes the peer sent in its handshake.
+func (p *Peer) Reserved() Reserved {
+	return p.reserved
+}
+
+// PeerID returns the ID the peer sent in its handshake.
+func (p *Peer) PeerID() [20]byte {
+	return p.peerID
+}
+
+// Addr returns the address the peer accepts connections on.
+func (p *Peer) Addr() model.PeerInfo {
+	return model.PeerInfo{IP: net.ParseIP(p.ip), Port: p.port}
+}
+
+// ReadMessage reads the next message sent by the peer, nil is returned for a keep-alive.
+func (p *Peer) ReadMessage() (*Message, error) {
+	return ReadMessage(p.conn)
+}
+
+// WriteMessage sends the message to the peer, it is safe for concurrent use.
+// The write fails if the peer doesn't take the message within writeTimeout.
+func (p *Peer) WriteMessage(msg *Message) error {
+	p.writeMux.Lock()
+	defer p.writeMux.Unlock()
+
+	return p.write(msg)
+}
+
+// write sends the message, p.writeMux must be held.
+func (p *Peer) write(msg *Message) error {
+	if err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := p.conn.Write(msg.Serialize())
+	return err
+}
+
+// readMessages reads messages until the connection fails or quit is closed.
+func (p *Peer) readMessages(messages chan<- *Message, errs chan<- error, quit <-chan struct{}) {
+	for {
+		if err := p.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			errs <- err
+			return
+		}
+		msg, err := p.ReadMessage()
+		if err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case messages <- msg:
+		case <-quit:
+			return
 		}
 	}
+}
+
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+func (p *Peers) count() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return len(p.peers)
+}
 
-	return false
+// list returns the connected peers.
+func (p *Peers) list() []*Peer {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	peers := make([]*Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, peer)
+	}
+	return peers
 }
@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// Peer exchange, see http://bittorrent.org/beps/bep_0011.html
+const (
+	utPex = "ut_pex"
+
+	pexInterval           = time.Minute
+	pexMinReceiveInterval = 30 * time.Second // messages that come sooner from the same peer are dropped
+	maxPexPeers           = 50               // the most added and the most dropped peers in one message
+
+	pexFlagConnectable = 0x10
+)
+
+type (
+	// pexState is the exchange with a single peer.
+	pexState struct {
+		lastSent     time.Time
+		lastReceived time.Time
+		sent         map[string]model.PeerInfo // the peers the peer learnt from us by address
+	}
+
+	// pexExtension is the ut_pex extension of the torrent, it is never registered for private torrents.
+	pexExtension struct {
+		t *Torrent
+	}
+
+	pexPeer struct {
+		model.PeerInfo
+		flags byte
+	}
+)
+
+func (e *pexExtension) Name() string {
+	return utPex
+}
+
+func (e *pexExtension) OnHandshake(*Peer) error {
+	return nil // the first tick sends the peers we are connected to
+}
+
+// Tick sends the peers connected and disconnected since the last message, once per pexInterval.
+func (e *pexExtension) Tick(peer *Peer) error {
+	if e.t.info().Private || time.Since(peer.pex.lastSent) < pexInterval {
+		return nil
+	}
+	peer.pex.lastSent = time.Now()
+	if peer.pex.sent == nil {
+		peer.pex.sent = make(map[string]model.PeerInfo)
+	}
+
+	// the listen port of a peer that connected to us is unknown, so only the peers we connected to are shared
+	current := make(map[string]*Peer)
+	for _, p := range e.t.peers.list() {
+		if p != peer && p.outgoing {
+			current[peerAddress(p.Addr())] = p
+		}
+	}
+
+	added := make([]pexPeer, 0)
+	for address, p := range current {
+		if len(added) == maxPexPeers {
+			break
+		}
+		if _, ok := peer.pex.sent[address]; ok {
+			continue
+		}
+		added = append(added, pexPeer{PeerInfo: p.Addr(), flags: pexFlagConnectable})
+		peer.pex.sent[address] = p.Addr()
+	}
+
+	dropped := make([]model.PeerInfo, 0)
+	for address, info := range peer.pex.sent {
+		if len(dropped) == maxPexPeers {
+			break
+		}
+		if _, ok := current[address]; ok {
+			continue
+		}
+		dropped = append(dropped, info)
+		delete(peer.pex.sent, address)
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		return err
+	}
+	return peer.WriteExtended(utPex, payload)
+}
+
+// HandleMessage queues the added peers as candidates, the number of peers taken from one peer is limited
+// by pexMinReceiveInterval and maxPexPeers.
+func (e *pexExtension) HandleMessage(peer *Peer, payload []byte) error {
+	if e.t.info().Private {
+		return nil
+	}
+	if !peer.pex.lastReceived.IsZero() && time.Since(peer.pex.lastReceived) < pexMinReceiveInterval {
+		return nil
+	}
+	peer.pex.lastReceived = time.Now()
+
+	added, err := parsePex(payload)
+	if err != nil {
+		return err
+	}
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+	e.t.candidates.add(added)
+	return nil
+}
+
+func encodePex(added []pexPeer, dropped []model.PeerInfo) ([]byte, error) {
+	added4, added6 := make([]model.PeerInfo, 0), make([]model.PeerInfo, 0)
+	flags4, flags6 := make([]byte, 0), make([]byte, 0)
+	for _, p := range added {
+		if p.IP.To4() != nil {
+			added4 = append(added4, p.PeerInfo)
+			flags4 = append(flags4, p.flags)
+		} else {
+			added6 = append(added6, p.PeerInfo)
+			flags6 = append(flags6, p.flags)
+		}
+	}
+
+	return bencode.Encode(map[string]interface{}{
+		"added":    string(bencode.CompactPeers(added4, net.IPv4len)),
+		"added.f":  string(flags4),
+		"added6":   string(bencode.CompactPeers(added6, net.IPv6len)),
+		"added6.f": string(flags6),
+		"dropped":  string(bencode.CompactPeers(dropped, net.IPv4len)),
+		"dropped6": string(bencode.CompactPeers(dropped, net.IPv6len)),
+	})
+}
+
+// parsePex returns the added peers of the message, dropped peers are of no use to us.
+func parsePex(payload []byte) ([]model.PeerInfo, error) {
+	value, _, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ut_pex message: %w", err)
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ut_pex message is not a dictionary")
+	}
+
+	peers := make([]model.PeerInfo, 0)
+	for key, ipLen := range map[string]int{"added": net.IPv4len, "added6": net.IPv6len} {
+		raw, _ := dict[key].(string)
+		added, err := bencode.ParseCompactPeers([]byte(raw), ipLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+		peers = append(peers, added...)
+	}
+	return peers, nil
+}
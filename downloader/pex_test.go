@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func TestPexRoundTrip(t *testing.T) {
+	added := []pexPeer{
+		{PeerInfo: model.PeerInfo{IP: net.IP{10, 0, 0, 1}, Port: 6881}, flags: pexFlagConnectable},
+		{PeerInfo: model.PeerInfo{IP: net.ParseIP("2001:db8::1"), Port: 51413}},
+	}
+	payload, err := encodePex(added, []model.PeerInfo{{IP: net.IP{10, 0, 0, 2}, Port: 6881}})
+	if err != nil {
+		t.Fatalf("encodePex() error = %v", err)
+	}
+
+	got, err := parsePex(payload)
+	if err != nil {
+		t.Fatalf("parsePex() error = %v", err)
+	}
+	want := []model.PeerInfo{added[0].PeerInfo, added[1].PeerInfo}
+	if len(got) != 2 {
+		t.Fatalf("parsePex() got = %v, want %v", got, want)
+	}
+	if got[0].Port != 6881 { // the order of the address families is not defined
+		got[0], got[1] = got[1], got[0]
+	}
+	for i := range want {
+		if !got[i].IP.Equal(want[i].IP) || got[i].Port != want[i].Port {
+			t.Errorf("parsePex() got = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	c := newCandidates()
+	peers := make([]model.PeerInfo, maxCandidates+10)
+	for i := range peers {
+		peers[i] = model.PeerInfo{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6881}
+	}
+
+	if got := c.add(peers[:2]); got != 2 {
+		t.Errorf("add() got = %v, want 2", got)
+	}
+	if got := c.add(peers[:2]); got != 0 {
+		t.Errorf("add() of queued peers got = %v, want 0", got)
+	}
+	if got := c.add(peers); got != maxCandidates-2 {
+		t.Errorf("add() over the limit got = %v, want %v", got, maxCandidates-2)
+	}
+
+	taken := c.take(2)
+	if !reflect.DeepEqual(taken, peers[:2]) {
+		t.Errorf("take() got = %v, want %v", taken, peers[:2])
+	}
+	if got := c.add(peers[:1]); got != 1 {
+		t.Errorf("add() of a taken peer got = %v, want 1", got)
+	}
+	if c.len() != maxCandidates-1 {
+		t.Errorf("len() got = %v, want %v", c.len(), maxCandidates-1)
+	}
+}
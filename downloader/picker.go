@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"math/rand"
+)
+
+const randomFirstPieces = 4 // the first pieces are picked at random to have something to trade with soon
+
+type (
+	// Picker decides which piece is started next. It is called with the lock of the piece queue held,
+	// so implementations don't need to be safe for concurrent use.
+	Picker interface {
+		// Available changes the number of connected peers that have the piece by delta.
+		Available(index, delta int)
+		// Pick returns one of the candidates to start next, candidates is never empty.
+		// Completed is the number of pieces verified so far.
+		Pick(candidates []int, completed int) int
+	}
+
+	// PickerFactory creates the picker of a torrent with numPieces pieces.
+	PickerFactory func(numPieces int) Picker
+
+	// rarestFirstPicker starts the pieces fewest peers have, so they spread before their owners leave.
+	rarestFirstPicker struct {
+		availability []int
+	}
+
+	// sequentialPicker starts the pieces in order.
+	sequentialPicker struct{}
+)
+
+func NewRarestFirstPicker(numPieces int) Picker {
+	return &rarestFirstPicker{availability: make([]int, numPieces)}
+}
+
+func NewSequentialPicker(int) Picker {
+	return sequentialPicker{}
+}
+
+func (p *rarestFirstPicker) Available(index, delta int) {
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index] += delta
+	}
+}
+
+// Pick returns a random candidate for the first pieces, since a rare piece is slow to get and
+// a new peer needs a complete piece soon to be unchoked. Ties of availability are broken at random.
+func (p *rarestFirstPicker) Pick(candidates []int, completed int) int {
+	if completed < randomFirstPieces {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	rarest := make([]int, 0)
+	for _, index := range candidates {
+		switch {
+		case len(rarest) == 0 || p.availability[index] < p.availability[rarest[0]]:
+			rarest = append(rarest[:0], index)
+		case p.availability[index] == p.availability[rarest[0]]:
+			rarest = append(rarest, index)
+		}
+	}
+	return rarest[rand.Intn(len(rarest))]
+}
+
+func (sequentialPicker) Available(int, int) {}
+
+func (sequentialPicker) Pick(candidates []int, _ int) int {
+	first := candidates[0]
+	for _, index := range candidates {
+		if index < first {
+			first = index
+		}
+	}
+	return first
+}
@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"testing"
+)
+
+func TestRarestFirstPicker(t *testing.T) {
+	tests := []struct {
+		name         string
+		availability []int
+		candidates   []int
+		completed    int
+		want         []int
+	}{
+		{
+			name:         "rarest",
+			availability: []int{3, 1, 2, 5},
+			candidates:   []int{0, 1, 2, 3},
+			completed:    randomFirstPieces,
+			want:         []int{1},
+		},
+		{
+			name:         "rarest of the candidates",
+			availability: []int{3, 1, 2, 5},
+			candidates:   []int{0, 2, 3},
+			completed:    randomFirstPieces,
+			want:         []int{2},
+		},
+		{
+			name:         "tie",
+			availability: []int{2, 1, 1, 5},
+			candidates:   []int{0, 1, 2, 3},
+			completed:    randomFirstPieces,
+			want:         []int{1, 2},
+		},
+		{
+			name:         "random first",
+			availability: []int{3, 1, 2, 5},
+			candidates:   []int{0, 3},
+			completed:    0,
+			want:         []int{0, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRarestFirstPicker(len(tt.availability))
+			for index, n := range tt.availability {
+				p.Available(index, n)
+			}
+			got := p.Pick(tt.candidates, tt.completed)
+			for _, want := range tt.want {
+				if got == want {
+					return
+				}
+			}
+			t.Errorf("Pick() got = %v, want one of %v", got, tt.want)
+		})
+	}
+}
+
+func TestPieceQueue(t *testing.T) {
+	pieces := make([]*pieceWork, 4)
+	for index := range pieces {
+		pieces[index] = &pieceWork{index: index, length: 2 * blockSize}
+	}
+	complete := func(index int) bool { return index == 0 }
+	q := newPieceQueue(pieces, complete, NewSequentialPicker(len(pieces)))
+	all := Bitfield{0xf0}
+
+	first := q.take(all)
+	if first == nil || first.work.index != 1 {
+		t.Fatalf("take() got = %v, want piece 1", first)
+	}
+
+	// the blocks received before the choke are kept for the next peer
+	first.nextRequest()
+	first.nextRequest()
+	if err := first.putBlock(0, make([]byte, blockSize-1)); err == nil {
+		t.Fatalf("putBlock() of a short block error = nil, want an error")
+	}
+	if err := first.putBlock(0, make([]byte, blockSize)); err != nil {
+		t.Fatalf("putBlock() error = %v", err)
+	}
+	q.putBack(first)
+	if got := q.take(all); got != first || got.downloaded != blockSize || len(got.outstanding()) != 0 {
+		t.Fatalf("take() got = %v, want the partial piece 1 without requests", got)
+	}
+
+	// a peer that has only other pieces gets none of the taken ones
+	if got := q.take(Bitfield{0x40}); got != nil {
+		t.Errorf("take() got = %v, want nil", got)
+	}
+	second, third := q.take(all), q.take(all)
+	if second == nil || second.work.index != 2 || third == nil || third.work.index != 3 {
+		t.Fatalf("take() got = %v, %v, want pieces 2 and 3", second, third)
+	}
+
+	// endgame, every piece left is taken, so duplicates are handed out
+	duplicate := q.take(all)
+	if duplicate == nil || duplicate == first || duplicate.work.index == 0 {
+		t.Fatalf("take() got = %v, want a duplicate of a piece in progress", duplicate)
+	}
+	index := duplicate.work.index
+	if !q.finish(index) {
+		t.Errorf("finish() got = false, want true")
+	}
+	if q.finish(index) {
+		t.Errorf("finish() of the duplicate got = true, want false")
+	}
+	if !q.isDone(index) {
+		t.Errorf("isDone() got = false, want true")
+	}
+
+	// a failed piece is downloaded again
+	other := 2
+	if index == 2 {
+		other = 3
+	}
+	q.failed(other)
+	if got := q.take(all); got == nil || got.work.index != other || got.downloaded != 0 {
+		t.Errorf("take() got = %v, want piece %d from scratch", got, other)
+	}
+}
+
+func TestPieceQueueEndgameSkipsDone(t *testing.T) {
+	pieces := []*pieceWork{{index: 0, length: blockSize}, {index: 1, length: blockSize}}
+	q := newPieceQueue(pieces, func(int) bool { return false }, NewSequentialPicker(len(pieces)))
+	all := Bitfield{0xc0}
+
+	first, second := q.take(all), q.take(all)
+	if first == nil || second == nil {
+		t.Fatalf("take() got = %v, %v, want both pieces", first, second)
+	}
+	// the first piece gets a duplicate and is verified, the second one is still downloaded by one peer
+	if duplicate := q.take(all); duplicate == nil || duplicate.work.index != 0 {
+		t.Fatalf("take() got = %v, want a duplicate of piece 0", duplicate)
+	}
+	if !q.finish(0) {
+		t.Fatalf("finish() got = false, want true")
+	}
+
+	for i := 0; i < maxEndgameDownloaders; i++ {
+		if got := q.take(all); got != nil && got.work.index == 0 {
+			t.Fatalf("take() got the verified piece 0 in endgame")
+		}
+	}
+}
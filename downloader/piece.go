@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+)
+
+const (
+	blockSize  = 16384 // 16 KiB, the largest block most clients will serve
+	maxBacklog = 5     // number of unfulfilled requests kept in flight per peer
+)
+
+type (
+	pieceWork struct {
+		index  int
+		hash   [20]byte
+		length int
+	}
+
+	pieceResult struct {
+		index int
+		buf   []byte
+	}
+
+	pieceProgress struct {
+		work       *pieceWork
+		buf        []byte
+		received   []bool
+		requested  []bool // requested and not received yet
+		downloaded int
+		backlog    int
+	}
+
+	block struct {
+		begin  int
+		length int
+	}
+)
+
+func newPieceProgress(pw *pieceWork) *pieceProgress {
+	numBlocks := (pw.length + blockSize - 1) / blockSize
+	return &pieceProgress{
+		work:      pw,
+		buf:       make([]byte, pw.length),
+		received:  make([]bool, numBlocks),
+		requested: make([]bool, numBlocks),
+	}
+}
+
+// nextRequest returns the begin offset and length of the next block to request.
+func (p *pieceProgress) nextRequest() (begin, length int) {
+	for i := range p.received {
+		if p.received[i] || p.requested[i] {
+			continue
+		}
+		p.requested[i] = true
+		p.backlog++
+		return p.block(i)
+	}
+	return 0, 0
+}
+
+func (p *pieceProgress) wantsMoreRequests() bool {
+	if p.backlog >= maxBacklog {
+		return false
+	}
+	for i := range p.received {
+		if !p.received[i] && !p.requested[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// putBlock copies the block into the piece buffer, duplicate blocks are ignored.
+func (p *pieceProgress) putBlock(begin int, data []byte) error {
+	if begin%blockSize != 0 || begin >= len(p.buf) {
+		return fmt.Errorf("unexpected block offset %d for piece %d", begin, p.work.index)
+	}
+	blockIndex := begin / blockSize
+	if _, length := p.block(blockIndex); len(data) != length {
+		return fmt.Errorf("unexpected block length %d at offset %d, want %d", len(data), begin, length)
+	}
+	if p.requested[blockIndex] {
+		p.requested[blockIndex] = false
+		p.backlog--
+	}
+	if p.received[blockIndex] {
+		return nil
+	}
+
+	copy(p.buf[begin:], data)
+	p.received[blockIndex] = true
+	p.downloaded += len(data)
+	return nil
+}
+
+// outstanding returns the blocks requested and not received yet.
+func (p *pieceProgress) outstanding() []block {
+	blocks := make([]block, 0, p.backlog)
+	for i, requested := range p.requested {
+		if requested {
+			begin, length := p.block(i)
+			blocks = append(blocks, block{begin: begin, length: length})
+		}
+	}
+	return blocks
+}
+
+// forgetRequests drops the outstanding requests, e.g. when the peer chokes us, the received blocks are kept.
+func (p *pieceProgress) forgetRequests() {
+	for i := range p.requested {
+		p.requested[i] = false
+	}
+	p.backlog = 0
+}
+
+func (p *pieceProgress) block(i int) (begin, length int) {
+	begin = i * blockSize
+	length = blockSize
+	if p.work.length-begin < length {
+		length = p.work.length - begin
+	}
+	return begin, length
+}
+
+func (p *pieceProgress) complete() bool {
+	return p.downloaded >= p.work.length
+}
+
+func checkIntegrity(pw *pieceWork, buf []byte) error {
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], pw.hash[:]) {
+		return fmt.Errorf("piece %d failed integrity check", pw.index)
+	}
+	return nil
+}
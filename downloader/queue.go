@@ -0,0 +1,238 @@
+package downloader
+
+import (
+	"sync"
+)
+
+const maxEndgameDownloaders = 3 // the most peers that download the same piece in endgame
+
+// pieceQueue hands out the pieces that are left to download. Pieces a peer gave up on are finished first,
+// new pieces are chosen by the picker, and once every remaining piece is being downloaded the endgame starts:
+// peers download pieces others are already on, whoever finishes first wins and the others cancel.
+type pieceQueue struct {
+	mux       sync.Mutex
+	picker    Picker
+	pieces    []*pieceWork
+	pending   map[int]bool           // pieces nobody has started
+	partial   map[int]*pieceProgress // pieces a peer gave up on, with the blocks it received
+	active    map[int]int            // pieces being downloaded and by how many peers
+	done      []bool
+	completed int
+
+	windows    map[int]pieceWindow // the pieces around the read positions of the streaming readers
+	nextWindow int
+}
+
+// pieceWindow is a range of pieces [first, last] that is started before any other piece.
+type pieceWindow struct {
+	first int
+	last  int
+}
+
+// newPieceQueue queues every piece that isn't complete already.
+func newPieceQueue(pieces []*pieceWork, complete func(index int) bool, picker Picker) *pieceQueue {
+	q := &pieceQueue{
+		picker:  picker,
+		pieces:  pieces,
+		pending: make(map[int]bool),
+		partial: make(map[int]*pieceProgress),
+		active:  make(map[int]int),
+		done:    make([]bool, len(pieces)),
+		windows: make(map[int]pieceWindow),
+	}
+	for index := range pieces {
+		if complete(index) {
+			q.done[index] = true
+			q.completed++
+			continue
+		}
+		q.pending[index] = true
+	}
+	return q
+}
+
+// take returns the piece the peer should download next, or nil if the peer has nothing we need.
+func (q *pieceQueue) take(has Bitfield) *pieceProgress {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	// the most complete partial piece is finished first
+	var best *pieceProgress
+	for index, progress := range q.partial {
+		if has.HasPiece(index) && (best == nil || progress.downloaded > best.downloaded) {
+			best = progress
+		}
+	}
+	if best != nil {
+		delete(q.partial, best.work.index)
+		q.active[best.work.index]++
+		return best
+	}
+
+	candidates := make([]int, 0)
+	for index := range q.pending {
+		if has.HasPiece(index) {
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) > 0 {
+		index, ok := q.urgent(candidates)
+		if !ok {
+			index = q.picker.Pick(candidates, q.completed)
+		}
+		delete(q.pending, index)
+		q.active[index]++
+		return newPieceProgress(q.pieces[index])
+	}
+
+	if len(q.pending) > 0 || len(q.partial) > 0 {
+		return nil // other peers have the pieces that are left
+	}
+	return q.takeEndgame(has)
+}
+
+// takeEndgame returns a duplicate of the active piece with the fewest downloaders that the peer has,
+// verified pieces are skipped even while peers still download them.
+func (q *pieceQueue) takeEndgame(has Bitfield) *pieceProgress {
+	index, downloaders := -1, maxEndgameDownloaders
+	for i, n := range q.active {
+		if n < downloaders && !q.done[i] && has.HasPiece(i) {
+			index, downloaders = i, n
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	q.active[index]++
+	return newPieceProgress(q.pieces[index])
+}
+
+// putBack returns a piece the peer didn't finish, the blocks it received are kept unless another peer
+// still downloads the piece.
+func (q *pieceQueue) putBack(progress *pieceProgress) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	index := progress.work.index
+	if !q.release(index) {
+		return
+	}
+	progress.forgetRequests()
+	if progress.downloaded > 0 {
+		q.partial[index] = progress
+	} else {
+		q.pending[index] = true
+	}
+}
+
+// failed returns a piece that failed verification, it is downloaded again from scratch.
+func (q *pieceQueue) failed(index int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.release(index) {
+		q.pending[index] = true
+	}
+}
+
+// finish marks the piece verified, false is returned if another peer finished it first.
+func (q *pieceQueue) finish(index int) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.release(index)
+	if q.done[index] {
+		return false
+	}
+	q.done[index] = true
+	q.completed++
+	return true
+}
+
+// reopen queues a finished piece again, its data never reached the storage.
+func (q *pieceQueue) reopen(index int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.done[index] {
+		q.done[index] = false
+		q.completed--
+		q.pending[index] = true
+	}
+}
+
+// isDone reports whether the piece is verified, peers downloading a duplicate in endgame check it to cancel.
+func (q *pieceQueue) isDone(index int) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.done[index]
+}
+
+// release removes a downloader of the piece and reports whether the piece has to be queued again.
+func (q *pieceQueue) release(index int) bool {
+	if q.active[index] > 1 {
+		q.active[index]--
+		return false
+	}
+	delete(q.active, index)
+	return !q.done[index]
+}
+
+// available changes the availability of the pieces in the bitfield by delta.
+func (q *pieceQueue) available(bitfield Bitfield, delta int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for index := range q.pieces {
+		if bitfield.HasPiece(index) {
+			q.picker.Available(index, delta)
+		}
+	}
+}
+
+func (q *pieceQueue) availableOne(index, delta int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.picker.Available(index, delta)
+}
+
+// urgent returns the candidate closest to the start of a window, false if no candidate is in a window.
+func (q *pieceQueue) urgent(candidates []int) (int, bool) {
+	best, distance := -1, len(q.pieces)
+	for _, index := range candidates {
+		for _, w := range q.windows {
+			if index >= w.first && index <= w.last && index-w.first < distance {
+				best, distance = index, index-w.first
+			}
+		}
+	}
+	return best, best >= 0
+}
+
+// addWindow returns the ID of a new window that prioritizes nothing until it is moved.
+func (q *pieceQueue) addWindow() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.nextWindow++
+	q.windows[q.nextWindow] = pieceWindow{first: 0, last: -1}
+	return q.nextWindow
+}
+
+func (q *pieceQueue) moveWindow(id int, w pieceWindow) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if _, ok := q.windows[id]; ok {
+		q.windows[id] = w
+	}
+}
+
+func (q *pieceQueue) removeWindow(id int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	delete(q.windows, id)
+}
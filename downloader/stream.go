@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+const defaultReadahead = 4 << 20 // 4 MiB, enough to keep a video playing while the next pieces arrive
+
+var ErrReaderClosed = errors.New("reader is closed")
+
+// Reader reads a file of a torrent while it downloads. The pieces from the read position to the readahead
+// are downloaded before any other piece, and Read blocks until the piece at the read position is verified.
+type Reader struct {
+	closed int32 // accessed atomically
+
+	t         *Torrent
+	file      model.FileInfo
+	window    int
+	pos       int64
+	readahead int64
+}
+
+// Files returns the files of the torrent, nil until the metadata is known.
+func (t *Torrent) Files() []model.FileInfo {
+	if !t.hasMetadata() {
+		return nil
+	}
+	return storage.Files(t.info())
+}
+
+// NewReader returns a reader of the file with the index, the metadata must be known.
+// The reader must be closed, the pieces it prioritizes are released then.
+func (t *Torrent) NewReader(file int) (*Reader, error) {
+	files := t.Files()
+	if files == nil {
+		return nil, fmt.Errorf("metadata is not known yet")
+	}
+	if file < 0 || file >= len(files) {
+		return nil, fmt.Errorf("file index %d is out of range", file)
+	}
+
+	return &Reader{
+		t:         t,
+		file:      files[file],
+		window:    t.queue.addWindow(),
+		readahead: defaultReadahead,
+	}, nil
+}
+
+// SetReadahead sets how many bytes after the read position are prioritized.
+func (r *Reader) SetReadahead(readahead int64) {
+	r.readahead = readahead
+}
+
+// Read reads from the current position, it blocks until the piece at the position is verified.
+func (r *Reader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return 0, ErrReaderClosed
+	}
+	if r.pos >= r.file.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	offset := r.file.Offset + r.pos
+	pieceLength := r.t.torrentInfo.PieceLength
+	piece := int(offset / pieceLength)
+	r.prioritize(offset)
+	if err := r.wait(piece); err != nil {
+		return 0, err
+	}
+
+	begin := offset - int64(piece)*pieceLength
+	n := int64(len(p))
+	if left := int64(r.t.pieceLength(piece)) - begin; left < n {
+		n = left
+	}
+	if left := r.file.Length - r.pos; left < n {
+		n = left
+	}
+	data, err := r.t.storage.ReadBlock(piece, begin, int(n))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read block of piece #%d: %w", piece, err)
+	}
+
+	copy(p, data)
+	r.pos += n
+	return int(n), nil
+}
+
+// Seek sets the position of the next Read, the pieces are prioritized once Read is called.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.file.Length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close releases the prioritized pieces and unblocks a pending Read, it is safe to call from another goroutine.
+func (r *Reader) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return nil
+	}
+	r.t.queue.removeWindow(r.window)
+
+	r.t.completedMux.Lock()
+	r.t.verified.Broadcast()
+	r.t.completedMux.Unlock()
+	return nil
+}
+
+// prioritize moves the window of the reader to the pieces from the offset to the readahead within the file.
+func (r *Reader) prioritize(offset int64) {
+	end := offset + r.readahead
+	if fileEnd := r.file.Offset + r.file.Length; end > fileEnd {
+		end = fileEnd
+	}
+	pieceLength := r.t.torrentInfo.PieceLength
+	first := int(offset / pieceLength)
+	last := int((end - 1) / pieceLength)
+	if last < first {
+		last = first
+	}
+	r.t.queue.moveWindow(r.window, pieceWindow{first: first, last: last})
+}
+
+// wait blocks until the piece is verified, the reader is closed or the torrent is stopped.
+func (r *Reader) wait(piece int) error {
+	r.t.completedMux.Lock()
+	defer r.t.completedMux.Unlock()
+
+	for !r.t.completed.HasPiece(piece) {
+		if atomic.LoadInt32(&r.closed) == 1 {
+			return ErrReaderClosed
+		}
+		if isClosed(r.t.stopped) {
+			return ErrTorrentStopped
+		}
+		r.t.verified.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/storage"
+)
+
+func TestReader(t *testing.T) {
+	data := []byte("aaaaabbbbbbb")
+	torrentInfo := model.TorrentInfo{
+		InfoHash:    [20]byte{4, 5, 6},
+		PieceLength: 4,
+		Length:      int64(len(data)),
+		Name:        "stream",
+		Files: []model.FileInfo{
+			{Path: []string{"a"}, Offset: 0, Length: 5},
+			{Path: []string{"b.txt"}, Offset: 5, Length: 7},
+		},
+	}
+	for begin := 0; begin < len(data); begin += 4 {
+		torrentInfo.PieceHashes = append(torrentInfo.PieceHashes, sha1.Sum(data[begin:begin+4]))
+	}
+	store := storage.NewMemoryStorage(torrentInfo)
+	torrent, err := NewTorrent([20]byte{'r'}, torrentInfo, time.Second, store)
+	if err != nil {
+		t.Fatalf("NewTorrent() error = %v", err)
+	}
+	complete := func(piece int) {
+		if err := store.WriteBlock(piece, 0, data[piece*4:piece*4+4]); err != nil {
+			t.Fatalf("WriteBlock() error = %v", err)
+		}
+		torrent.markCompleted(piece)
+	}
+
+	reader, err := torrent.NewReader(1)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if _, err = reader.Seek(1, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 10)
+		n, err := reader.Read(buf)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		read <- string(buf[:n])
+	}()
+
+	// the piece at the read position is picked first once the reader waits for it
+	var progress *pieceProgress
+	for i := 0; i < 100 && progress == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		torrent.queue.mux.Lock()
+		window := torrent.queue.windows[reader.window]
+		torrent.queue.mux.Unlock()
+		if window.last >= 0 {
+			progress = torrent.queue.take(Bitfield{0xe0})
+		}
+	}
+	if progress == nil || progress.work.index != 1 {
+		t.Fatalf("take() got = %v, want piece 1", progress)
+	}
+	select {
+	case got := <-read:
+		t.Fatalf("Read() returned %q before the piece was verified", got)
+	default:
+	}
+
+	complete(1)
+	if got := <-read; got != "bb" {
+		t.Errorf("Read() got = %q, want %q", got, "bb")
+	}
+
+	if err = reader.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err = reader.Read(make([]byte, 1)); err != ErrReaderClosed {
+		t.Errorf("Read() error = %v, want %v", err, ErrReaderClosed)
+	}
+
+	complete(0)
+	complete(2)
+	d, err := NewTorrentDownloader([20]byte{'r'}, nil, time.Second)
+	if err != nil {
+		t.Fatalf("NewTorrentDownloader() error = %v", err)
+	}
+	d.add(torrent)
+	server := httptest.NewServer(d.StreamHandler())
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		rangeValue string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "whole file", path: "/1", wantStatus: http.StatusOK, wantBody: "bbbbbbb"},
+		{name: "range", path: "/1", rangeValue: "bytes=1-3", wantStatus: http.StatusPartialContent, wantBody: "bbb"},
+		{name: "first file", path: "/0", rangeValue: "bytes=3-", wantStatus: http.StatusPartialContent, wantBody: "aa"},
+		{name: "unknown file", path: "/2", wantStatus: http.StatusNotFound},
+		{name: "invalid index", path: "/x", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%x%s", server.URL, torrentInfo.InfoHash, tt.path), nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			if tt.rangeValue != "" {
+				req.Header.Set("Range", tt.rangeValue)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode got = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus >= http.StatusBadRequest {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body got = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
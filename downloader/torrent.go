@@ -1,90 +1,600 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/dht"
 	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+	"github.com/genvmoroz/simple-torrent-client/parser/magnet"
+	"github.com/genvmoroz/simple-torrent-client/storage"
 )
 
-const tcp = "tcp"
+const (
+	tcp           = "tcp"
+	flushInterval = 30 * time.Second
+	unknownLength = 16384 // reported as left until the metadata is known, zero would make us look like a seeder
+)
 
 type (
 	Torrent struct {
-		peerID      [20]byte
-		torrentInfo model.TorrentInfo
-		timeout     time.Duration
-		peers       Peers
+		// accessed atomically, kept first for 64-bit alignment
+		downloaded int64
+		uploaded   int64
+		dialing    int32
+
+		peerID       [20]byte
+		port         uint16 // the port we accept connections on, it is announced to trackers and peers
+		timeout      time.Duration
+		trackers     *client.Trackers
+		dht          *dht.DHT // nil if the DHT isn't used
+		peers        Peers
+		candidates   *candidates
+		initialPeers []string // host:port of peers to connect to before the trackers answer
+
+		// torrentInfo is incomplete until the metadata is known, it is guarded by infoMux until then
+		infoMux        sync.RWMutex
+		torrentInfo    model.TorrentInfo
+		metadata       *metadataExchange
+		metadataReady  chan struct{}
+		storageFactory storage.Factory
+
+		extensions *Extensions
+		picker     PickerFactory
+
+		// initialized once the metadata is known
+		storage storage.Storage
+		queue   *pieceQueue
+
+		results  chan *pieceResult
+		done     chan struct{} // closed once every piece is verified
+		doneOnce sync.Once
+		stopped  chan struct{} // closed by Stop
+
+		lifeMux sync.Mutex
+		state   torrentState
+		run     *run         // the goroutines of the torrent while it is running
+		event   client.Event // the event of the next announce, owned by the announcer while the torrent runs
+		// the download finished before started was answered, completed follows it
+		completedPending bool
+
+		completedMux   sync.RWMutex
+		verified       *sync.Cond // broadcast when a piece is verified, streaming readers wait on it
+		completed      Bitfield
+		completedSize  int
+		completedBytes int64
 	}
 )
 
-func NewTorrent(peerID [20]byte, torrentInfo model.TorrentInfo, timeout time.Duration) (*Torrent, error) {
-	return &Torrent{
+// NewTorrent creates a Torrent that starts from the pieces already complete in the storage.
+func NewTorrent(peerID [20]byte, torrentInfo model.TorrentInfo, timeout time.Duration, store storage.Storage) (*Torrent, error) {
+	t := newTorrent(peerID, torrentInfo, timeout)
+	t.initPieces(store)
+	close(t.metadataReady)
+
+	return t, nil
+}
+
+// NewMagnetTorrent creates a Torrent that knows only the info hash,
+// the metadata is fetched from peers before the download starts and the storage is created with storageFactory then.
+func NewMagnetTorrent(peerID [20]byte, link model.Magnet, timeout time.Duration, storageFactory storage.Factory) (*Torrent, error) {
+	t := newTorrent(peerID, magnet.ToTorrentInfo(link), timeout)
+	t.storageFactory = storageFactory
+	t.initialPeers = link.Peers
+
+	return t, nil
+}
+
+func newTorrent(peerID [20]byte, torrentInfo model.TorrentInfo, timeout time.Duration) *Torrent {
+	t := &Torrent{
 		peerID:      peerID,
+		port:        client.DefaultPort,
 		torrentInfo: torrentInfo,
 		timeout:     timeout,
+		trackers:    client.NewTrackers(torrentInfo),
 		peers: Peers{
-			peerIPs:   make([]string, 0),
+			peers:     make(map[string]*Peer),
 			mux:       sync.Mutex{},
 			peersChan: make(chan *Peer, 1024),
+			choker:    newChoker(defaultUploadSlots),
 		},
-	}, nil
+		stopped:       make(chan struct{}),
+		event:         client.EventStarted,
+		candidates:    newCandidates(),
+		metadata:      newMetadataExchange(torrentInfo.InfoHash),
+		metadataReady: make(chan struct{}),
+		extensions:    NewExtensions(),
+		picker:        NewRarestFirstPicker,
+		results:       make(chan *pieceResult),
+		done:          make(chan struct{}),
+	}
+
+	t.verified = sync.NewCond(&t.completedMux)
+
+	// the IDs are assigned in the order of registration, there are no duplicates
+	_ = t.extensions.Register(&metadataExtension{t: t})
+	_ = t.extensions.Register(&donthaveExtension{t: t})
+	if !torrentInfo.Private {
+		_ = t.extensions.Register(&pexExtension{t: t})
+	}
+
+	return t
+}
+
+// initPieces queues the pieces that are not complete in the storage, the metadata must be known.
+func (t *Torrent) initPieces(store storage.Storage) {
+	t.storage = store
+	t.completed = NewBitfieldOfSize(len(t.torrentInfo.PieceHashes))
+
+	pieces := make([]*pieceWork, len(t.torrentInfo.PieceHashes))
+	for index, hash := range t.torrentInfo.PieceHashes {
+		if store.IsComplete(index) {
+			t.markCompleted(index)
+		}
+		pieces[index] = &pieceWork{
+			index:  index,
+			hash:   hash,
+			length: t.pieceLength(index),
+		}
+	}
+	t.queue = newPieceQueue(pieces, t.hasPiece, t.picker(len(pieces)))
 }
 
-func (t *Torrent) ConnectToPeers() error {
-	trackerInfo, err := client.GetTrackerInfo(t.torrentInfo, t.peerID)
+// setPicker replaces the strategy that picks the pieces, it must be called before the download starts.
+func (t *Torrent) setPicker(factory PickerFactory) {
+	t.picker = factory
+	if t.queue != nil {
+		t.queue.picker = factory(len(t.queue.pieces))
+	}
+}
+
+// setMetadata verifies the info dictionary received from peers and initializes the pieces of the torrent.
+func (t *Torrent) setMetadata(rawInfo []byte) error {
+	info, err := bencode.ParseInfo(rawInfo)
 	if err != nil {
-		return fmt.Errorf("failed to get TrackerInfo: %w", err)
+		return fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	if info.InfoHash != t.torrentInfo.InfoHash {
+		return fmt.Errorf("metadata doesn't match the info hash")
 	}
 
-	for _, peerInfo := range trackerInfo.Peers {
-		go func(pi model.PeerInfo) {
-			if err = t.connectToPeer(pi); err != nil {
-				log.Printf("failed to connect to peer, peerIP: %s, err: %s", pi.IP.String(), err)
-			}
-		}(peerInfo)
+	t.infoMux.Lock()
+	t.torrentInfo.PieceHashes = info.PieceHashes
+	t.torrentInfo.PieceLength = info.PieceLength
+	t.torrentInfo.Length = info.Length
+	t.torrentInfo.Name = info.Name
+	t.torrentInfo.Files = info.Files
+	t.torrentInfo.Private = info.Private
+	t.torrentInfo.Source = info.Source
+	t.torrentInfo.RawInfo = info.RawInfo
+	t.infoMux.Unlock()
+
+	store, err := t.storageFactory(t.info())
+	if err != nil {
+		return fmt.Errorf("failed to create storage: %w", err)
 	}
+	t.initPieces(store)
+	close(t.metadataReady)
 
+	log.Printf("metadata is received, torrent name: %s", info.Name)
 	return nil
 }
 
-func (t *Torrent) connectToPeer(peerInfo model.PeerInfo) error {
+// info returns a copy of the torrent info, safe to call before the metadata is known.
+func (t *Torrent) info() model.TorrentInfo {
+	t.infoMux.RLock()
+	defer t.infoMux.RUnlock()
+
+	return t.torrentInfo
+}
+
+func (t *Torrent) hasMetadata() bool {
+	return isClosed(t.metadataReady)
+}
+
+func (t *Torrent) isComplete() bool {
+	return t.hasMetadata() && t.numCompleted() == len(t.torrentInfo.PieceHashes)
+}
+
+// connectToPeers queues the peers to be connected by the connector.
+func (t *Torrent) connectToPeers(peers []model.PeerInfo) {
+	t.candidates.add(peers)
+}
+
+func (t *Torrent) dial(r *run, peerInfo model.PeerInfo) {
+	atomic.AddInt32(&t.dialing, 1)
+	r.spawn(func() {
+		defer atomic.AddInt32(&t.dialing, -1)
+		if err := t.connectToPeer(r.ctx, peerInfo); err != nil {
+			log.Printf("failed to connect to peer, address: %s, err: %s", peerAddress(peerInfo), err)
+		}
+	})
+}
+
+func (t *Torrent) numDialing() int {
+	return int(atomic.LoadInt32(&t.dialing))
+}
+
+func (t *Torrent) connectToInitialPeers() {
+	peers := make([]model.PeerInfo, 0, len(t.initialPeers))
+	for _, address := range t.initialPeers {
+		addr, err := net.ResolveTCPAddr(tcp, address)
+		if err != nil {
+			log.Printf("failed to resolve peer address: %s, err: %s", address, err.Error())
+			continue
+		}
+		peers = append(peers, model.PeerInfo{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	t.connectToPeers(peers)
+}
+
+// connectToPeer connects to the peer and hands it to Download, resolving the host name, the dial and the handshake
+// must finish within the timeout.
+func (t *Torrent) connectToPeer(ctx context.Context, peerInfo model.PeerInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	if peerInfo.IP == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, peerInfo.Host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", peerInfo.Host, err)
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("%s has no addresses", peerInfo.Host)
+		}
+		peerInfo.IP = addrs[0].IP
+		if ip4 := peerInfo.IP.To4(); ip4 != nil {
+			peerInfo.IP = ip4
+		}
+	}
+
 	if t.peers.existPeerIP(peerInfo.IP.String()) {
 		log.Println("the port with such portIP is already presented, return")
 		return nil
 	}
 
-	peer, err := ConnectToPeer(tcp, peerInfo.IP.String(), peerInfo.Port, t.torrentInfo.InfoHash, t.peerID)
+	peer, err := ConnectToPeer(ctx, tcp, peerInfo.IP.String(), peerInfo.Port, t.torrentInfo.InfoHash, t.peerID)
 	if err != nil {
 		log.Printf("failed to connect to Peer: %s", err.Error())
 	} else {
 		if err = t.peers.addPeer(peerInfo.IP.String(), peer); err != nil {
-			log.Printf("failed to add peer for torrent, name: %s, err: %s", t.torrentInfo.Name, err.Error())
+			log.Printf("failed to add peer for torrent, name: %s, err: %s", t.info().Name, err.Error())
 		}
 	}
 
 	return nil
 }
 
-func (t *Torrent) Download() {
-	for peer := range t.peers.peersChan {
-		go func(p *Peer) {
-			if err := t.download(p); err != nil {
-				log.Printf("faield to download from peer, peerIP: %s, err: %s", p.ip, err)
-			}
-		}(peer)
+// Download starts the torrent and returns once every piece is verified, the download fails or the context is done.
+// The torrent keeps running after Download returns, it seeds until it is paused or stopped.
+func (t *Torrent) Download(ctx context.Context) error {
+	if err := t.Start(); err != nil {
+		return err
+	}
+	t.lifeMux.Lock()
+	r := t.run
+	t.lifeMux.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case err := <-r.errs:
+		return err
+	case <-t.stopped:
+		return ErrTorrentStopped
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (t *Torrent) download(peer *Peer) error {
+// download serves the peer until the connection fails or the run ends.
+func (t *Torrent) download(ctx context.Context, peer *Peer) error {
 	defer func() {
+		t.peerGone(peer)
 		if err := t.peers.removePeerIP(peer.ip); err != nil {
 			log.Printf("failed to remove peerIP: %s", err.Error())
 		}
+		if err := peer.Close(); err != nil {
+			log.Printf("failed to close peer connection, peerIP: %s, err: %s", peer.ip, err)
+		}
 	}()
 
+	messages := make(chan *Message)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go peer.readMessages(messages, errs, quit)
+
+	// the bitfield may only be sent right after the handshake
+	if t.hasMetadata() && t.numCompleted() > 0 {
+		peer.announced = t.completedSnapshot()
+		if err := peer.WriteMessage(NewBitfield(peer.announced)); err != nil {
+			return fmt.Errorf("failed to send bitfield: %w", err)
+		}
+	}
+	if peer.Reserved().SupportsExtensions() {
+		if err := t.sendExtendedHandshake(peer); err != nil {
+			return fmt.Errorf("failed to send extended handshake: %w", err)
+		}
+	}
+	if !t.isComplete() {
+		if err := peer.WriteMessage(NewInterested()); err != nil {
+			return fmt.Errorf("failed to send interested: %w", err)
+		}
+		peer.amInterested = true
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var progress *pieceProgress
+	defer func() {
+		if progress != nil {
+			t.queue.putBack(progress)
+		}
+	}()
+
+	for {
+		if t.hasMetadata() && !peer.counted {
+			if err := t.peerHas(peer); err != nil {
+				return err
+			}
+		}
+		if progress != nil && t.queue.isDone(progress.work.index) {
+			// another peer finished the piece first in endgame
+			if err := t.cancelRequests(peer, progress); err != nil {
+				return err
+			}
+			progress = nil
+		}
+		if progress == nil && !peer.choked && t.hasMetadata() {
+			progress = t.queue.take(peer.bitfield)
+		}
+		if progress != nil && !peer.choked {
+			for progress.wantsMoreRequests() {
+				begin, length := progress.nextRequest()
+				if err := peer.WriteMessage(NewRequest(progress.work.index, begin, length)); err != nil {
+					return fmt.Errorf("failed to send request: %w", err)
+				}
+			}
+		}
+
+		// the connection stays open once the torrent is complete, the peer may still download from us
+		select {
+		case err := <-errs:
+			return fmt.Errorf("failed to read message: %w", err)
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := t.sendHaves(peer); err != nil {
+				return err
+			}
+			if err := t.tickExtensions(peer); err != nil {
+				return err
+			}
+		case msg := <-messages:
+			if err := t.handleMessage(ctx, peer, msg, &progress); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *Torrent) handleMessage(ctx context.Context, peer *Peer, msg *Message, progress **pieceProgress) error {
+	if msg == nil { // keep-alive
+		return nil
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		peer.choked = true
+		if *progress != nil {
+			// the peer drops our outstanding requests, the received blocks are finished later
+			t.queue.putBack(*progress)
+			*progress = nil
+		}
+	case MsgUnchoke:
+		peer.choked = false
+	case MsgInterested:
+		atomic.StoreInt32(&peer.interested, 1)
+		if err := t.peers.unchokeIfFree(peer); err != nil {
+			return fmt.Errorf("failed to send unchoke: %w", err)
+		}
+	case MsgNotInterested:
+		atomic.StoreInt32(&peer.interested, 0)
+	case MsgRequest:
+		if err := t.serveRequest(peer, msg); err != nil {
+			return err
+		}
+	case MsgHave:
+		index, err := ParseHave(msg)
+		if err != nil {
+			return fmt.Errorf("failed to parse have: %w", err)
+		}
+		if err = t.peerHave(peer, index); err != nil {
+			return err
+		}
+	case MsgBitfield:
+		bitfield, err := ParseBitfield(msg)
+		if err != nil {
+			return fmt.Errorf("failed to parse bitfield: %w", err)
+		}
+		if t.hasMetadata() {
+			err = bitfield.check(len(t.info().PieceHashes))
+		} else if len(bitfield) > (maxPieces+7)/8 {
+			err = fmt.Errorf("bitfield of length %d exceeds the largest torrent", len(bitfield))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid bitfield: %w", err)
+		}
+		t.peerGone(peer)
+		peer.bitfield = bitfield
+	case MsgExtended:
+		if err := t.handleExtended(peer, msg); err != nil {
+			return fmt.Errorf("failed to handle extended message: %w", err)
+		}
+	case MsgPiece:
+		index, begin, block, err := ParsePiece(msg)
+		if err != nil {
+			return fmt.Errorf("failed to parse piece: %w", err)
+		}
+		atomic.AddInt64(&t.downloaded, int64(len(block)))
+		atomic.AddInt64(&peer.downloaded, int64(len(block)))
+		p := *progress
+		if p == nil || p.work.index != index {
+			return nil // late block of a piece we gave up on
+		}
+		if err = p.putBlock(begin, block); err != nil {
+			return err
+		}
+		if !p.complete() {
+			return nil
+		}
+
+		*progress = nil
+		if err = checkIntegrity(p.work, p.buf); err != nil {
+			log.Printf("discarding piece from peer, peerIP: %s, err: %s", peer.ip, err)
+			t.queue.failed(index)
+			return nil
+		}
+		if !t.queue.finish(index) {
+			return nil
+		}
+		select {
+		case t.results <- &pieceResult{index: index, buf: p.buf}:
+		case <-ctx.Done():
+			t.queue.reopen(index) // the writer is gone, the piece is downloaded again on resume
+		}
+	}
+
+	return nil
+}
+
+// cancelRequests cancels the requests of the piece that are still outstanding.
+func (t *Torrent) cancelRequests(peer *Peer, progress *pieceProgress) error {
+	for _, b := range progress.outstanding() {
+		if err := peer.WriteMessage(NewCancel(progress.work.index, b.begin, b.length)); err != nil {
+			return fmt.Errorf("failed to send cancel: %w", err)
+		}
+	}
+	t.queue.putBack(progress)
+	return nil
+}
+
+// peerHas counts the pieces of the peer in the availability, the bitfield is counted once the metadata is known.
+// A bitfield received before the metadata is checked against the number of pieces then, one built from haves
+// is shorter and gets padded.
+func (t *Torrent) peerHas(peer *Peer) error {
+	numPieces := len(t.info().PieceHashes)
+	bitfield := NewBitfieldOfSize(numPieces)
+	if len(peer.bitfield) > len(bitfield) {
+		return fmt.Errorf("invalid bitfield: expected length %d, got length %d", len(bitfield), len(peer.bitfield))
+	}
+	copy(bitfield, peer.bitfield)
+	if err := bitfield.check(numPieces); err != nil {
+		return fmt.Errorf("invalid bitfield: %w", err)
+	}
+
+	peer.bitfield = bitfield
+	t.queue.available(peer.bitfield, 1)
+	peer.counted = true
+	return nil
+}
+
+// peerHave adds a piece the peer announced with have. Before the metadata is known the index is limited
+// by the largest torrent, so the bitfield can't grow without bound.
+func (t *Torrent) peerHave(peer *Peer, index int) error {
+	limit := maxPieces
+	if t.hasMetadata() {
+		limit = len(t.info().PieceHashes)
+	}
+	if index < 0 || index >= limit {
+		return fmt.Errorf("have of piece #%d is out of range", index)
+	}
+
+	if index/8 >= len(peer.bitfield) { // the number of pieces may be unknown yet
+		peer.bitfield = append(peer.bitfield, make(Bitfield, index/8+1-len(peer.bitfield))...)
+	}
+	if peer.counted && !peer.bitfield.HasPiece(index) {
+		t.queue.availableOne(index, 1)
+	}
+	peer.bitfield.SetPiece(index)
 	return nil
 }
+
+// peerLost removes a piece the peer doesn't have anymore.
+func (t *Torrent) peerLost(peer *Peer, index int) {
+	if peer.counted && peer.bitfield.HasPiece(index) {
+		t.queue.availableOne(index, -1)
+	}
+	peer.bitfield.ClearPiece(index)
+}
+
+// peerGone removes the pieces of the peer from the availability.
+func (t *Torrent) peerGone(peer *Peer) {
+	if peer.counted {
+		t.queue.available(peer.bitfield, -1)
+		peer.counted = false
+	}
+}
+
+func (t *Torrent) pieceLength(index int) int {
+	begin := int64(index) * t.torrentInfo.PieceLength
+	end := begin + t.torrentInfo.PieceLength
+	if end > t.torrentInfo.Length {
+		end = t.torrentInfo.Length
+	}
+	return int(end - begin)
+}
+
+func (t *Torrent) markCompleted(index int) {
+	t.completedMux.Lock()
+	defer t.completedMux.Unlock()
+
+	if !t.completed.HasPiece(index) {
+		t.completed.SetPiece(index)
+		t.completedSize++
+		t.completedBytes += int64(t.pieceLength(index))
+		t.verified.Broadcast()
+	}
+}
+
+// completedSnapshot returns a copy of the bitfield of the verified pieces.
+func (t *Torrent) completedSnapshot() Bitfield {
+	t.completedMux.RLock()
+	defer t.completedMux.RUnlock()
+
+	return append(Bitfield(nil), t.completed...)
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.completedMux.RLock()
+	defer t.completedMux.RUnlock()
+
+	return t.completed.HasPiece(index)
+}
+
+func (t *Torrent) bytesLeft() int64 {
+	if !t.hasMetadata() {
+		return unknownLength
+	}
+
+	t.completedMux.RLock()
+	defer t.completedMux.RUnlock()
+
+	return t.torrentInfo.Length - t.completedBytes
+}
+
+func (t *Torrent) numCompleted() int {
+	t.completedMux.RLock()
+	defer t.completedMux.RUnlock()
+
+	return t.completedSize
+}
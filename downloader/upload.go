@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const maxRequestLength = 128 * 1024 // clients request 16 KiB blocks, anything much larger is abuse
+
+// serveRequest sends the requested block if we have its piece, requests for pieces we don't have are ignored.
+func (t *Torrent) serveRequest(peer *Peer, msg *Message) error {
+	index, begin, length, err := ParseRequest(msg)
+	if err != nil {
+		return fmt.Errorf("failed to parse request: %w", err)
+	}
+	if length <= 0 || length > maxRequestLength {
+		return fmt.Errorf("requested block length %d is out of range", length)
+	}
+	if !peer.isUnchoked() || !t.hasMetadata() || !t.hasPiece(index) {
+		return nil // requests of choked peers are dropped, they ask again once unchoked
+	}
+	if begin < 0 || begin+length > t.pieceLength(index) {
+		return fmt.Errorf("requested block [%d, %d) is out of piece #%d", begin, begin+length, index)
+	}
+
+	block, err := t.storage.ReadBlock(index, int64(begin), length)
+	if err != nil {
+		return fmt.Errorf("failed to read block of piece #%d: %w", index, err)
+	}
+	if err = peer.WriteMessage(NewPiece(index, begin, block)); err != nil {
+		return fmt.Errorf("failed to send piece: %w", err)
+	}
+	atomic.AddInt64(&t.uploaded, int64(length))
+	atomic.AddInt64(&peer.uploaded, int64(length))
+	return nil
+}
+
+// sendHaves tells the peer about the pieces verified since it was told last,
+// and that we aren't interested anymore once the torrent is complete.
+func (t *Torrent) sendHaves(peer *Peer) error {
+	if !t.hasMetadata() {
+		return nil
+	}
+
+	completed := t.completedSnapshot()
+	if peer.announced == nil {
+		peer.announced = make(Bitfield, len(completed))
+	}
+	for i := range completed {
+		if completed[i] == peer.announced[i] {
+			continue
+		}
+		for index := i * 8; index < i*8+8; index++ {
+			if !completed.HasPiece(index) || peer.announced.HasPiece(index) {
+				continue
+			}
+			if err := peer.WriteMessage(NewHave(index)); err != nil {
+				return fmt.Errorf("failed to send have: %w", err)
+			}
+			peer.announced.SetPiece(index)
+		}
+	}
+
+	if peer.amInterested && t.isComplete() {
+		if err := peer.WriteMessage(NewNotInterested()); err != nil {
+			return fmt.Errorf("failed to send not interested: %w", err)
+		}
+		peer.amInterested = false
+	}
+	return nil
+}
@@ -1,5 +1,3 @@
 module github.com/genvmoroz/simple-torrent-client
 
 go 1.16
-
-require github.com/jackpal/bencode-go v1.0.0
@@ -1,51 +1,167 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/genvmoroz/simple-torrent-client/dht"
 	"github.com/genvmoroz/simple-torrent-client/downloader"
 	"github.com/genvmoroz/simple-torrent-client/loader"
 	"github.com/genvmoroz/simple-torrent-client/model"
 	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+	"github.com/genvmoroz/simple-torrent-client/parser/magnet"
+	"github.com/genvmoroz/simple-torrent-client/tracker"
+)
+
+const (
+	defaultTorrent  = "./test.torrent"
+	defaultDHTState = "./.dht.json"
+	defaultStream   = "127.0.0.1:8080" // files are served to this machine only
+	defaultTracker  = ":6969"          // the peers of the swarm must reach the tracker
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
-	content, err := loader.ReadFile("./test.torrent")
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		if err := create(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	streamAddr := flag.String("stream", defaultStream, "address the files are streamed on")
+	trackerAddr := flag.String("tracker", defaultTracker, "address the embedded HTTP and UDP tracker listens on, the stream address may be shared")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "usage: [flags] [torrent file or magnet link...] | create [flags] <path>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	sources := flag.Args()
+	if len(sources) == 0 {
+		sources = []string{defaultTorrent}
 	}
 
 	peerID := [20]byte{}
-	_, err = rand.Read(peerID[:])
+	_, err := rand.Read(peerID[:])
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	torrentInfo, err := bencode.ParseTorrentInfo(content)
+	torrentInfos := make([]model.TorrentInfo, 0, len(sources))
+	magnets := make([]model.Magnet, 0)
+	for _, source := range sources {
+		if strings.HasPrefix(source, "magnet:") {
+			link, err := magnet.Parse(source)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			magnets = append(magnets, link)
+			continue
+		}
 
-	torrentDownloader, err := downloader.NewTorrentDownloader(peerID, []model.TorrentInfo{torrentInfo}, 10*time.Second)
+		content, err := loader.ReadFile(source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		torrentInfo, err := bencode.ParseTorrentInfo(content)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		torrentInfos = append(torrentInfos, torrentInfo)
+	}
+
+	opts := make([]downloader.Option, 0)
+	node, err := dht.New(dht.Config{StatePath: defaultDHTState})
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("failed to start dht, continuing with trackers only, err: %s", err.Error())
+	} else {
+		defer func() { _ = node.Close() }()
+		opts = append(opts, downloader.WithDHT(node))
 	}
 
-	if err = torrentDownloader.Download(); err != nil {
+	torrentDownloader, err := downloader.NewTorrentDownloader(peerID, torrentInfos, 10*time.Second, opts...)
+	if err != nil {
 		log.Fatalln(err)
 	}
-}
+	for _, link := range magnets {
+		if err = torrentDownloader.AddMagnet(link); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
-type workingBatch struct {
-	index  int
-	hash   [20]byte
-	length int
-}
+	seeding := true
+	if err = torrentDownloader.Listen(); err != nil {
+		log.Printf("failed to accept peers, continuing without seeding, err: %s", err.Error())
+		seeding = false
+	}
 
-func download(t model.TorrentInfo) {
-	//workingBatches := make(chan *workingBatch, len(t.PieceHashes))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	//goroutinesHum := runtime.NumCPU()
+	// the embedded tracker answers UDP announces on the port of its HTTP server,
+	// which is shared with streaming when both listen on the same address
+	registry := tracker.NewRegistry(tracker.Config{})
+	go registry.Run(ctx)
+	trackerHandler := tracker.NewHTTPHandler(registry)
+	streamMux := http.NewServeMux()
+	streamMux.Handle("/", torrentDownloader.StreamHandler())
+	trackerMux := streamMux
+	if *trackerAddr != *streamAddr {
+		trackerMux = http.NewServeMux()
+		go serveHTTP(*trackerAddr, trackerMux)
+	}
+	trackerMux.Handle("/announce", trackerHandler)
+	trackerMux.Handle("/scrape", trackerHandler)
+	log.Printf("streaming files at http://%s/<info hash>/<file index>, tracking at http://%s/announce", *streamAddr, *trackerAddr)
+	go serveHTTP(*streamAddr, streamMux)
+	if err = serveUDPTracker(ctx, *trackerAddr, registry); err != nil {
+		log.Printf("failed to serve udp tracker, err: %s", err.Error())
+	}
+
+	if err = torrentDownloader.Download(ctx); err == nil && seeding {
+		log.Println("seeding, press Ctrl+C to stop")
+		<-ctx.Done()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = torrentDownloader.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down, err: %s", err.Error())
+	}
+}
 
-	fmt.Println(t.PieceLength / 20)
+func serveHTTP(addr string, handler http.Handler) {
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Printf("failed to serve http on %s, err: %s", addr, err.Error())
+	}
+}
+
+func serveUDPTracker(ctx context.Context, addr string, registry *tracker.Registry) error {
+	server, err := tracker.NewUDPServer(registry)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		log.Printf("tracking at udp://%s", addr)
+		_ = server.Serve(conn)
+	}()
+	return nil
 }
@@ -0,0 +1,280 @@
+package metainfo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+const (
+	minPieceLength = 16 << 10 // one block, the smallest piece peers can exchange
+	maxPieceLength = 16 << 20
+	maxPieces      = 1500 // the automatic piece length keeps the number of pieces below this
+)
+
+type (
+	// Config describes the torrent to create, zero fields take the defaults.
+	Config struct {
+		Path         string     // the file or directory to share
+		Name         string     // the base name of the path by default
+		PieceLength  int64      // a power of two of at least 16 KiB, chosen from the total length by default
+		Announce     string     // the first tracker of the announce list by default
+		AnnounceList [][]string // tiers of trackers, see http://bittorrent.org/beps/bep_0012.html
+		Comment      string
+		CreatedBy    string
+		CreationDate time.Time // the current time by default
+		Private      bool
+		Source       string
+		Workers      int // the number of pieces hashed in parallel, the number of CPUs by default
+	}
+
+	// source is a file to share, path is its location on disk.
+	source struct {
+		path   string
+		info   model.FileInfo
+		single bool
+	}
+
+	piece struct {
+		index int
+		data  []byte
+	}
+)
+
+// Create builds the torrent of the file or directory, writes its bencoded metainfo to w and returns the torrent.
+func Create(ctx context.Context, cfg Config, w io.Writer) (model.TorrentInfo, error) {
+	sources, length, err := walk(cfg.Path)
+	if err != nil {
+		return model.TorrentInfo{}, err
+	}
+	if length == 0 {
+		return model.TorrentInfo{}, fmt.Errorf("%s has no data to share", cfg.Path)
+	}
+
+	pieceLength := cfg.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLength(length)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return model.TorrentInfo{}, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, minPieceLength)
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	pieceHashes, err := hashPieces(ctx, sources, length, pieceLength, workers)
+	if err != nil {
+		return model.TorrentInfo{}, err
+	}
+
+	torrentInfo := model.TorrentInfo{
+		Announce:     cfg.Announce,
+		AnnounceList: cfg.AnnounceList,
+		Comment:      cfg.Comment,
+		CreatedBy:    cfg.CreatedBy,
+		CreationDate: cfg.CreationDate,
+		PieceHashes:  pieceHashes,
+		PieceLength:  pieceLength,
+		Length:       length,
+		Name:         cfg.Name,
+		Private:      cfg.Private,
+		Source:       cfg.Source,
+	}
+	if torrentInfo.Announce == "" && len(cfg.AnnounceList) > 0 && len(cfg.AnnounceList[0]) > 0 {
+		torrentInfo.Announce = cfg.AnnounceList[0][0]
+	}
+	if torrentInfo.CreationDate.IsZero() {
+		torrentInfo.CreationDate = time.Now()
+	}
+	if torrentInfo.Name == "" {
+		// the absolute path names paths like "." after the directory
+		path, err := filepath.Abs(cfg.Path)
+		if err != nil {
+			return model.TorrentInfo{}, fmt.Errorf("failed to resolve %s: %w", cfg.Path, err)
+		}
+		torrentInfo.Name = filepath.Base(path)
+	}
+	if !sources[0].single {
+		for _, s := range sources {
+			torrentInfo.Files = append(torrentInfo.Files, s.info)
+		}
+	}
+
+	content, err := bencode.EncodeTorrentInfo(torrentInfo)
+	if err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to encode torrent: %w", err)
+	}
+	if _, err = w.Write(content); err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to write torrent: %w", err)
+	}
+
+	// parsing the output fills the info hash and the raw info the way any reader of the file sees them
+	return bencode.ParseTorrentInfo(bytes.NewReader(content))
+}
+
+// PieceLength returns the piece length for the total length: the smallest power of two that gives
+// at most 1500 pieces, within 16 KiB and 16 MiB.
+func PieceLength(length int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && (length+pieceLength-1)/pieceLength > maxPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// walk returns the regular files at the path in lexical order and their total length.
+// A path to a file gives a single-file torrent.
+func walk(root string) ([]source, int64, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat %s: %w", root, err)
+	}
+	if !stat.IsDir() {
+		info := model.FileInfo{Path: []string{stat.Name()}, Length: stat.Size()}
+		return []source{{path: root, info: info, single: true}}, stat.Size(), nil
+	}
+
+	var sources []source
+	var offset int64
+	err = filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source{
+			path: path,
+			info: model.FileInfo{Path: strings.Split(filepath.ToSlash(rel), "/"), Offset: offset, Length: fileInfo.Size()},
+		})
+		offset += fileInfo.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+	if len(sources) == 0 {
+		return nil, 0, fmt.Errorf("%s has no files", root)
+	}
+	return sources, offset, nil
+}
+
+// hashPieces reads the files one after another and hashes their pieces with the workers.
+func hashPieces(ctx context.Context, sources []source, length, pieceLength int64, workers int) ([][20]byte, error) {
+	hashes := make([][20]byte, (length+pieceLength-1)/pieceLength)
+	pieces := make(chan piece)
+	// the buffers bound the memory to a couple of pieces per worker
+	buffers := make(chan []byte, 2*workers)
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- make([]byte, pieceLength)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pieces {
+				hashes[p.index] = sha1.Sum(p.data)
+				buffers <- p.data[:cap(p.data)]
+			}
+		}()
+	}
+
+	err := readPieces(ctx, sources, buffers, pieces)
+	close(pieces)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// readPieces sends the pieces of the files in order, the data of a piece is read into a free buffer.
+// Each file is read up to its walked length, a file that changed size since the walk is an error.
+func readPieces(ctx context.Context, sources []source, buffers chan []byte, pieces chan<- piece) error {
+	var buf []byte
+	var filled int64
+	index := 0
+	send := func(data []byte) error {
+		select {
+		case pieces <- piece{index: index, data: data}:
+			index++
+			filled = 0
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, s := range sources {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", s.path, err)
+		}
+		r := io.LimitReader(file, s.info.Length)
+		var read int64
+		for {
+			if buf == nil {
+				select {
+				case buf = <-buffers:
+				case <-ctx.Done():
+					_ = file.Close()
+					return ctx.Err()
+				}
+			}
+			n, err := io.ReadFull(r, buf[filled:])
+			filled += int64(n)
+			read += int64(n)
+			if filled == int64(len(buf)) {
+				if err = send(buf); err != nil {
+					_ = file.Close()
+					return err
+				}
+				buf = nil
+				continue
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				_ = file.Close()
+				return fmt.Errorf("failed to read %s: %w", s.path, err)
+			}
+		}
+		if read == s.info.Length {
+			// the file must end at its walked length
+			n, _ := file.Read(make([]byte, 1))
+			if n > 0 {
+				read++
+			}
+		}
+		if err = file.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %w", s.path, err)
+		}
+		if read != s.info.Length {
+			return fmt.Errorf("%s changed while hashing, want %d bytes", s.path, s.info.Length)
+		}
+	}
+
+	if filled > 0 {
+		return send(buf[:filled])
+	}
+	return nil
+}
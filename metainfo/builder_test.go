@@ -0,0 +1,214 @@
+package metainfo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+}
+
+func pieceHashes(data []byte, pieceLength int) [][20]byte {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return hashes
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	a := bytes.Repeat([]byte{'a'}, 20000)
+	b := bytes.Repeat([]byte{'b'}, 30000)
+	c := bytes.Repeat([]byte{'c'}, 5)
+	writeFiles(t, dir, map[string][]byte{"data/x/a": a, "data/b": b, "data/empty": nil, "data/x/c": c, "single": b})
+
+	created := time.Unix(1609502400, 0)
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    model.TorrentInfo
+		wantErr bool
+	}{
+		{
+			name: "directory",
+			cfg: Config{
+				Path:         filepath.Join(dir, "data"),
+				PieceLength:  minPieceLength,
+				AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+				Comment:      "comment",
+				CreatedBy:    "test",
+				CreationDate: created,
+				Private:      true,
+				Source:       "source",
+				Workers:      3,
+			},
+			want: model.TorrentInfo{
+				Announce:     "http://a/announce",
+				AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+				Comment:      "comment",
+				CreatedBy:    "test",
+				CreationDate: created,
+				PieceHashes:  pieceHashes(append(append(append([]byte{}, b...), a...), c...), minPieceLength),
+				PieceLength:  minPieceLength,
+				Length:       50005,
+				Name:         "data",
+				Files: []model.FileInfo{
+					{Path: []string{"b"}, Offset: 0, Length: 30000},
+					{Path: []string{"empty"}, Offset: 30000, Length: 0},
+					{Path: []string{"x", "a"}, Offset: 30000, Length: 20000},
+					{Path: []string{"x", "c"}, Offset: 50000, Length: 5},
+				},
+				Private: true,
+				Source:  "source",
+			},
+		},
+		{
+			name: "single file with automatic piece length",
+			cfg:  Config{Path: filepath.Join(dir, "single"), Name: "renamed", Announce: "http://a/announce", CreationDate: created},
+			want: model.TorrentInfo{
+				Announce:     "http://a/announce",
+				CreationDate: created,
+				PieceHashes:  pieceHashes(b, minPieceLength),
+				PieceLength:  minPieceLength,
+				Length:       30000,
+				Name:         "renamed",
+			},
+		},
+		{
+			name:    "piece length is not a power of two",
+			cfg:     Config{Path: filepath.Join(dir, "single"), PieceLength: 3 * minPieceLength},
+			wantErr: true,
+		},
+		{
+			name:    "no data",
+			cfg:     Config{Path: filepath.Join(dir, "data", "empty")},
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			cfg:     Config{Path: filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			got, err := Create(context.Background(), tt.cfg, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			parsed, err := bencode.ParseTorrentInfo(&buf)
+			if err != nil {
+				t.Fatalf("ParseTorrentInfo() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, parsed) {
+				t.Errorf("Create() got = %+v, written %+v", got, parsed)
+			}
+			got.InfoHash, got.RawInfo = [20]byte{}, nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Create() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCanceled(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a": make([]byte, 4*minPieceLength)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Create(ctx, Config{Path: filepath.Join(dir, "a"), Workers: 1}, ioutil.Discard); err == nil {
+		t.Errorf("Create() error = nil, want the context error")
+	}
+}
+
+func TestHashPiecesChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a": make([]byte, 3*minPieceLength)})
+	path := filepath.Join(dir, "a")
+
+	tests := []struct {
+		name   string
+		length int64
+	}{
+		{name: "grown", length: minPieceLength},
+		{name: "shrunk", length: 4 * minPieceLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the walked length differs from the file on disk
+			sources := []source{{path: path, info: model.FileInfo{Path: []string{"a"}, Length: tt.length}, single: true}}
+			if _, err := hashPieces(context.Background(), sources, tt.length, minPieceLength, 2); err == nil {
+				t.Errorf("hashPieces() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestCreateCurrentDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a": []byte("data")})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd() error = %v", err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir() error = %v", err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	got, err := Create(context.Background(), Config{Path: "."}, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if want := filepath.Base(dir); got.Name != want {
+		t.Errorf("Create() got name = %q, want %q", got.Name, want)
+	}
+}
+
+func TestPieceLength(t *testing.T) {
+	tests := []struct {
+		length int64
+		want   int64
+	}{
+		{length: 1, want: 16 << 10},
+		{length: 1500 * 16 << 10, want: 16 << 10},
+		{length: 1500*16<<10 + 1, want: 32 << 10},
+		{length: 700 << 20, want: 512 << 10},
+		{length: 1 << 40, want: 16 << 20},
+	}
+	for _, tt := range tests {
+		if got := PieceLength(tt.length); got != tt.want {
+			t.Errorf("PieceLength(%d) got = %d, want %d", tt.length, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"fmt"
 	"net"
 	"time"
 )
@@ -16,17 +17,59 @@ type (
 		InfoHash     [20]byte
 		PieceHashes  [][20]byte
 		PieceLength  int64
-		Length       int64
+		Length       int64 // total length of all files
 		Name         string
+		Files        []FileInfo // empty for single-file torrents
+		Private      bool       // peers may only come from the trackers, see http://bittorrent.org/beps/bep_0027.html
+		Source       string     // set by private trackers to give the same data a different info hash
+		RawInfo      []byte     // bencoded info dictionary exactly as it was received
+	}
+
+	FileInfo struct {
+		Path   []string // path components relative to the torrent directory
+		Offset int64    // offset of the file within the torrent data
+		Length int64
 	}
 
 	TrackerInfo struct {
-		Interval int64
-		Peers    []PeerInfo
+		Interval       int64
+		MinInterval    int64
+		TrackerID      string
+		WarningMessage string
+		Complete       int64 // number of seeders
+		Incomplete     int64 // number of leechers
+		Peers          []PeerInfo
 	}
 
 	PeerInfo struct {
 		IP   net.IP
+		Host string // the DNS name a tracker sent instead of an IP, it is resolved when the peer is dialed
 		Port uint16
 	}
+
+	// ScrapeInfo is the state of a torrent on a tracker, see http://bittorrent.org/beps/bep_0048.html
+	ScrapeInfo struct {
+		Complete   int64 // number of seeders
+		Downloaded int64 // number of completed downloads
+		Incomplete int64 // number of leechers
+	}
+
+	// Magnet is the content of a magnet link, see http://bittorrent.org/beps/bep_0009.html
+	Magnet struct {
+		InfoHash   [20]byte
+		Name       string   // dn, display name
+		Trackers   []string // tr
+		WebSeeds   []string // ws
+		Peers      []string // x.pe, host:port of peers to connect to
+		SelectOnly []int    // so, indices of the files to download, see http://bittorrent.org/beps/bep_0053.html
+	}
+
+	// TrackerFailure is the failure reason reported by the tracker.
+	TrackerFailure struct {
+		Reason string
+	}
 )
+
+func (f *TrackerFailure) Error() string {
+	return fmt.Sprintf("tracker failure: %s", f.Reason)
+}
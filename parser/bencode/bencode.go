@@ -1,27 +1,89 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/genvmoroz/simple-torrent-client/model"
-	"github.com/jackpal/bencode-go"
 )
 
 func ParseTorrentInfo(r io.Reader) (model.TorrentInfo, error) {
+	// the info dictionary is kept raw, the info hash must be computed over the original bytes
 	b := bitTorrent{}
-	if err := bencode.Unmarshal(r, &b); err != nil {
-		return model.TorrentInfo{}, fmt.Errorf("failed to unmarshal: %w", err)
+	if err := NewDecoder(r).Decode(&b); err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to decode: %w", err)
+	}
+	if len(b.Info) == 0 || b.Info[0] != 'd' {
+		return model.TorrentInfo{}, fmt.Errorf("info dictionary is missing")
+	}
+
+	i := info{}
+	if err := Decode(b.Info, &i); err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to decode info: %w", err)
+	}
+	return toDomainBitTorrent(b, i)
+}
+
+// EncodeTorrentInfo returns the bencoded metainfo of the torrent. The info dictionary is built from the fields,
+// RawInfo and InfoHash are ignored.
+func EncodeTorrentInfo(torrentInfo model.TorrentInfo) ([]byte, error) {
+	torrent, err := fromDomainBitTorrent(torrentInfo)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(torrent)
+}
+
+// ParseInfo parses a bare info dictionary, e.g. the one received from peers with the metadata exchange.
+// Only the fields derived from the info dictionary are filled.
+func ParseInfo(rawInfo []byte) (model.TorrentInfo, error) {
+	if len(rawInfo) == 0 || rawInfo[0] != 'd' {
+		return model.TorrentInfo{}, fmt.Errorf("info is not a dictionary")
+	}
+	i := info{}
+	if err := Decode(rawInfo, &i); err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to decode: %w", err)
 	}
 
-	return toDomainBitTorrent(b)
+	torrentInfo, err := toDomainBitTorrent(bitTorrent{Info: rawInfo}, i)
+	if err != nil {
+		return model.TorrentInfo{}, err
+	}
+	torrentInfo.CreationDate = time.Time{}
+	return torrentInfo, nil
 }
 
+// ParseTrackerInfo parses the announce response, *model.TrackerFailure is returned when the tracker reports a failure.
 func ParseTrackerInfo(r io.Reader) (model.TrackerInfo, error) {
-	tr := trackerResponse{}
-	if err := bencode.Unmarshal(r, &tr); err != nil {
-		return model.TrackerInfo{}, fmt.Errorf("failed to unmarshal: %w", err)
+	// peers may be either a compact string or a list of dictionaries, so the response is decoded generically
+	dict := make(map[string]interface{})
+	if err := NewDecoder(r).Decode(&dict); err != nil {
+		return model.TrackerInfo{}, fmt.Errorf("failed to decode: %w", err)
 	}
 
-	return toDomainTrackerInfoWithoutPeersInfo(tr)
+	return toDomainTrackerInfo(toTrackerResponse(dict))
+}
+
+// ParseScrapeInfo parses the scrape response into the states of the torrents by info hash,
+// *model.TrackerFailure is returned when the tracker reports a failure.
+func ParseScrapeInfo(r io.Reader) (map[[20]byte]model.ScrapeInfo, error) {
+	dict := make(map[string]interface{})
+	if err := NewDecoder(r).Decode(&dict); err != nil {
+		return nil, fmt.Errorf("failed to decode: %w", err)
+	}
+
+	return toDomainScrapeInfo(dict)
+}
+
+// DecodePrefix decodes the value at the start of data and returns the number of bytes it takes,
+// the data that follows the value is left untouched.
+func DecodePrefix(data []byte) (interface{}, int, error) {
+	var value interface{}
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(&value); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode: %w", err)
+	}
+	return value, int(d.Offset()), nil
 }
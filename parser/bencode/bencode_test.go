@@ -1,7 +1,10 @@
 package bencode
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
@@ -11,7 +14,7 @@ import (
 )
 
 var (
-	correctText        = "d8:announce12:testAnnounce13:announce-listll13:testAnnounce1el13:testAnnounce2ee7:comment11:testComment10:created by14:uTorrent/3.5.513:creation datei1609502400e8:encoding5:UTF-84:infod6:lengthi835109565e4:name8:testName12:piece lengthi1048576e6:pieces20:testPiecesTestPiecesee"
+	correctText        = "d8:announce12:testAnnounce13:announce-listll13:testAnnounce1el13:testAnnounce2ee7:comment11:testComment10:created by14:uTorrent/3.5.513:creation datei1609502400e8:encoding5:UTF-84:infod6:lengthi1048576e4:name8:testName12:piece lengthi1048576e6:pieces20:testPiecesTestPiecesee"
 	expectedBitTorrent = model.TorrentInfo{
 		Announce: "testAnnounce",
 		AnnounceList: append(make([][]string, 0, 8),
@@ -22,13 +25,48 @@ var (
 		CreatedBy:    "uTorrent/3.5.5",
 		CreationDate: time.Unix(1609502400, 0),
 		Encoding:     "UTF-8",
-		InfoHash:     [20]byte{6, 127, 105, 243, 13, 160, 43, 122, 48, 152, 63, 198, 157, 143, 99, 9, 234, 213, 2, 250},
+		InfoHash:     [20]byte{135, 146, 87, 116, 36, 64, 82, 243, 169, 120, 76, 112, 16, 142, 254, 80, 150, 189, 66, 87},
 		PieceHashes: [][20]byte{
 			{116, 101, 115, 116, 80, 105, 101, 99, 101, 115, 84, 101, 115, 116, 80, 105, 101, 99, 101, 115},
 		},
 		PieceLength: 1048576,
-		Length:      835109565,
+		Length:      1048576,
 		Name:        "testName",
+		RawInfo:     []byte("d6:lengthi1048576e4:name8:testName12:piece lengthi1048576e6:pieces20:testPiecesTestPiecese"),
+	}
+
+	multiFileText               = "d8:announce12:testAnnounce4:infod5:filesld6:lengthi3e4:pathl1:a1:beed6:lengthi5e4:pathl1:ceee4:name4:root12:piece lengthi4e6:pieces40:testPiecesTestPiecestestPiecesTestPiecesee"
+	expectedMultiFileBitTorrent = model.TorrentInfo{
+		Announce:     "testAnnounce",
+		CreationDate: time.Unix(0, 0),
+		InfoHash:     [20]byte{227, 51, 78, 181, 181, 245, 14, 252, 110, 203, 196, 0, 6, 132, 62, 177, 185, 154, 55, 66},
+		PieceHashes: [][20]byte{
+			{116, 101, 115, 116, 80, 105, 101, 99, 101, 115, 84, 101, 115, 116, 80, 105, 101, 99, 101, 115},
+			{116, 101, 115, 116, 80, 105, 101, 99, 101, 115, 84, 101, 115, 116, 80, 105, 101, 99, 101, 115},
+		},
+		PieceLength: 4,
+		Length:      8,
+		Name:        "root",
+		Files: []model.FileInfo{
+			{Path: []string{"a", "b"}, Offset: 0, Length: 3},
+			{Path: []string{"c"}, Offset: 3, Length: 5},
+		},
+		RawInfo: []byte("d5:filesld6:lengthi3e4:pathl1:a1:beed6:lengthi5e4:pathl1:ceee4:name4:root12:piece lengthi4e6:pieces40:testPiecesTestPiecestestPiecesTestPiecese"),
+	}
+
+	unknownInfoKeysText               = "d4:infod6:lengthi3e4:name4:file12:piece lengthi4e6:pieces20:testPiecesTestPieces7:privatei1e6:source4:testee"
+	expectedUnknownInfoKeysBitTorrent = model.TorrentInfo{
+		CreationDate: time.Unix(0, 0),
+		InfoHash:     [20]byte{119, 76, 199, 9, 91, 236, 98, 144, 115, 21, 192, 219, 20, 77, 10, 99, 4, 23, 32, 128},
+		PieceHashes: [][20]byte{
+			{116, 101, 115, 116, 80, 105, 101, 99, 101, 115, 84, 101, 115, 116, 80, 105, 101, 99, 101, 115},
+		},
+		PieceLength: 4,
+		Length:      3,
+		Name:        "file",
+		Private:     true,
+		Source:      "test",
+		RawInfo:     []byte("d6:lengthi3e4:name4:file12:piece lengthi4e6:pieces20:testPiecesTestPieces7:privatei1e6:source4:teste"),
 	}
 
 	corruptedText = "corrupted"
@@ -49,11 +87,41 @@ func TestBenCodeParserParse(t *testing.T) {
 			args: args{r: strings.NewReader(correctText)},
 			want: expectedBitTorrent,
 		},
+		{
+			name: "multi-file",
+			args: args{r: strings.NewReader(multiFileText)},
+			want: expectedMultiFileBitTorrent,
+		},
+		{
+			name: "unknown info keys",
+			args: args{r: strings.NewReader(unknownInfoKeysText)},
+			want: expectedUnknownInfoKeysBitTorrent,
+		},
 		{
 			name:    "corrupted",
 			args:    args{r: strings.NewReader(corruptedText)},
 			wantErr: true,
 		},
+		{
+			name:    "unsafe name",
+			args:    args{r: strings.NewReader("d4:infod6:lengthi3e4:name5:../ab12:piece lengthi4e6:pieces20:testPiecesTestPiecesee")},
+			wantErr: true,
+		},
+		{
+			name:    "zero piece length",
+			args:    args{r: strings.NewReader("d4:infod6:lengthi3e4:name4:file12:piece lengthi0e6:pieces20:testPiecesTestPiecesee")},
+			wantErr: true,
+		},
+		{
+			name:    "negative length",
+			args:    args{r: strings.NewReader("d4:infod6:lengthi-3e4:name4:file12:piece lengthi4e6:pieces20:testPiecesTestPiecesee")},
+			wantErr: true,
+		},
+		{
+			name:    "missing piece hashes",
+			args:    args{r: strings.NewReader("d4:infod6:lengthi5e4:name4:file12:piece lengthi4e6:pieces20:testPiecesTestPiecesee")},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -68,3 +136,156 @@ func TestBenCodeParserParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTrackerInfo(t *testing.T) {
+	type args struct {
+		r io.Reader
+	}
+	tests := []struct {
+		name        string
+		args        args
+		want        model.TrackerInfo
+		wantFailure string
+		wantErr     bool
+	}{
+		{
+			name: "compact",
+			args: args{r: strings.NewReader("d8:completei5e10:incompletei3e8:intervali1800e12:min intervali60e5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe210:tracker id3:abc15:warning message4:caree")},
+			want: model.TrackerInfo{
+				Interval:       1800,
+				MinInterval:    60,
+				TrackerID:      "abc",
+				WarningMessage: "care",
+				Complete:       5,
+				Incomplete:     3,
+				Peers: []model.PeerInfo{
+					{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+				},
+			},
+		},
+		{
+			name: "dictionary peers",
+			args: args{r: strings.NewReader("d8:intervali900e5:peersld2:ip8:10.0.0.27:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip11:2001:db8::24:porti6882eed2:ip16:peer.example.org4:porti6883eeee")},
+			want: model.TrackerInfo{
+				Interval: 900,
+				Peers: []model.PeerInfo{
+					{IP: net.IP{10, 0, 0, 2}, Port: 6881},
+					{IP: net.ParseIP("2001:db8::2"), Port: 6882},
+					{Host: "peer.example.org", Port: 6883},
+				},
+			},
+		},
+		{
+			name:        "failure reason",
+			args:        args{r: strings.NewReader("d14:failure reason17:torrent not founde")},
+			wantFailure: "torrent not found",
+			wantErr:     true,
+		},
+		{
+			name:    "malformed peers",
+			args:    args{r: strings.NewReader("d8:intervali900e5:peers5:abcdee")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrackerInfo(tt.args.r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrackerInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var failure *model.TrackerFailure
+			if errors.As(err, &failure) != (tt.wantFailure != "") || (failure != nil && failure.Reason != tt.wantFailure) {
+				t.Errorf("ParseTrackerInfo() error = %v, want failure %q", err, tt.wantFailure)
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("ParseTrackerInfo() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScrapeInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[[20]byte]model.ScrapeInfo
+		wantErr bool
+	}{
+		{
+			name: "files",
+			body: "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10eeee",
+			want: map[[20]byte]model.ScrapeInfo{
+				{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}: {Complete: 5, Downloaded: 50, Incomplete: 10},
+			},
+		},
+		{
+			name: "no files",
+			body: "d5:filesdee",
+			want: map[[20]byte]model.ScrapeInfo{},
+		},
+		{
+			name:    "failure reason",
+			body:    "d14:failure reason17:torrent not founde",
+			wantErr: true,
+		},
+		{
+			name:    "short info hash",
+			body:    "d5:filesd3:abcd8:completei5eeee",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScrapeInfo(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseScrapeInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseScrapeInfo() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeTorrentInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		torrentInfo model.TorrentInfo
+		want        string
+	}{
+		{name: "single file", torrentInfo: expectedBitTorrent, want: correctText},
+		{name: "multi file", torrentInfo: expectedMultiFileBitTorrent, want: multiFileText},
+		{name: "private with source", torrentInfo: expectedUnknownInfoKeysBitTorrent, want: unknownInfoKeysText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EncodeTorrentInfo(tt.torrentInfo)
+			if err != nil {
+				t.Fatalf("EncodeTorrentInfo() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("EncodeTorrentInfo() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkParseTorrentInfo(b *testing.B) {
+	torrentInfo := expectedMultiFileBitTorrent
+	torrentInfo.PieceHashes = make([][20]byte, 50000)
+	data, err := EncodeTorrentInfo(torrentInfo)
+	if err != nil {
+		b.Fatalf("EncodeTorrentInfo() error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err = ParseTorrentInfo(bytes.NewReader(data)); err != nil {
+			b.Fatalf("ParseTorrentInfo() error = %v", err)
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	maxDepth     = 512     // lists and dictionaries nested deeper are rejected instead of exhausting the stack
+	maxIntDigits = 20      // enough for any int64 with its sign
+	stringChunk  = 1 << 20 // longer strings grow as their data arrives, a forged length can't allocate more than that
+)
+
+// Token kinds, a list or a dictionary runs until its End token.
+const (
+	Int TokenKind = iota + 1
+	String
+	List
+	Dict
+	End
+)
+
+type (
+	TokenKind int
+
+	// Token is a single element of the bencoded stream.
+	Token struct {
+		Kind   TokenKind
+		Int    int64  // the value of an Int
+		Bytes  []byte // the content of a String, owned by the caller
+		Offset int64  // offset of the token in the stream
+	}
+
+	// Decoder reads bencoded values from a stream. Strings are read straight into a buffer of their length.
+	Decoder struct {
+		r      reader
+		offset int64
+		strict bool
+
+		peeked    bool
+		peek      byte
+		recording bool
+		raw       []byte
+		stack     []container
+	}
+
+	// container is a list or a dictionary that is being read.
+	container struct {
+		dict    bool
+		key     bool // the next token of the dictionary is a key
+		lastKey []byte
+	}
+
+	reader interface {
+		io.Reader
+		io.ByteReader
+	}
+
+	// SyntaxError describes malformed or, in strict mode, non-canonical data.
+	SyntaxError struct {
+		Offset int64
+		msg    string
+	}
+)
+
+// Decode decodes the bencoded value that makes up all of data into v, see Decoder.Decode.
+func Decode(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{Offset: d.offset, msg: "data after the value"}
+	}
+	return nil
+}
+
+// NewDecoder returns a decoder that reads from r, r is buffered unless it is also an io.ByteReader.
+// Unbuffered, the decoder doesn't read past the values it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Strict makes the decoder reject encodings that aren't canonical: unsorted or duplicate dictionary keys,
+// integers and string lengths with leading zeros, and negative zero.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// Offset returns the number of bytes consumed so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Token returns the next token of the stream, io.EOF is returned at the end of a stream of complete values.
+// The structure is validated: dictionary keys are strings and every container is closed.
+func (d *Decoder) Token() (Token, error) {
+	offset := d.offset
+	c, err := d.readByte()
+	if err != nil {
+		if err == io.EOF && len(d.stack) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return Token{}, err
+	}
+
+	var top *container
+	if len(d.stack) > 0 {
+		top = &d.stack[len(d.stack)-1]
+	}
+
+	if c == 'e' {
+		if top == nil {
+			return Token{}, &SyntaxError{Offset: offset, msg: "end outside of a list or dictionary"}
+		}
+		if top.dict && !top.key {
+			return Token{}, &SyntaxError{Offset: offset, msg: "dictionary key without a value"}
+		}
+		d.stack = d.stack[:len(d.stack)-1]
+		d.valueDone()
+		return Token{Kind: End, Offset: offset}, nil
+	}
+
+	tok := Token{Offset: offset}
+	switch {
+	case c == 'i':
+		tok.Kind = Int
+		tok.Int, err = d.readInt()
+	case c >= '0' && c <= '9':
+		tok.Kind = String
+		tok.Bytes, err = d.readString(c)
+	case c == 'l' || c == 'd':
+		tok.Kind = List
+		if c == 'd' {
+			tok.Kind = Dict
+		}
+	default:
+		err = &SyntaxError{Offset: offset, msg: fmt.Sprintf("unexpected byte %q", c)}
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	if top != nil && top.dict && top.key {
+		if tok.Kind != String {
+			return Token{}, &SyntaxError{Offset: offset, msg: "dictionary key is not a string"}
+		}
+		if d.strict && top.lastKey != nil && bytes.Compare(tok.Bytes, top.lastKey) <= 0 {
+			return Token{}, &SyntaxError{Offset: offset, msg: fmt.Sprintf("key %q is not sorted", tok.Bytes)}
+		}
+		top.lastKey = tok.Bytes
+		top.key = false
+		return tok, nil
+	}
+
+	switch tok.Kind {
+	case List, Dict:
+		if len(d.stack) == maxDepth {
+			return Token{}, &SyntaxError{Offset: offset, msg: "nesting is too deep"}
+		}
+		d.stack = append(d.stack, container{dict: tok.Kind == Dict, key: tok.Kind == Dict})
+	default:
+		d.valueDone()
+	}
+	return tok, nil
+}
+
+// Decode reads the next value into v, which must be a non-nil pointer.
+// Integers decode into integer types, strings into strings, byte slices and byte arrays of the same length,
+// lists into slices and arrays, dictionaries into maps with string keys and into structs, see Encode for the tags.
+// Values decode into an empty interface as int64, string, []interface{} and map[string]interface{}.
+// Unknown dictionary keys are skipped, RawMessage keeps the exact bytes of a value.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("failed to decode into %T: not a non-nil pointer", v)
+	}
+	return d.value(rv.Elem())
+}
+
+func (s *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", s.msg, s.Offset)
+}
+
+func (d *Decoder) value(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		raw, err := d.capture()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if tok.Kind == End {
+		return &SyntaxError{Offset: tok.Offset, msg: "end instead of a value"}
+	}
+	return d.decodeToken(tok, v)
+}
+
+// decodeToken decodes the value that starts with the token into v.
+func (d *Decoder) decodeToken(tok Token, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeToken(tok, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError(tok, v)
+		}
+		value, err := d.generic(tok)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch tok.Kind {
+	case Int:
+		return setInt(tok, v)
+	case String:
+		return setString(tok, v)
+	case List:
+		return d.decodeList(tok, v)
+	default:
+		return d.decodeDict(tok, v)
+	}
+}
+
+func setInt(tok Token, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(tok.Int) {
+			return fmt.Errorf("integer %d overflows %s", tok.Int, v.Type())
+		}
+		v.SetInt(tok.Int)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if tok.Int < 0 || v.OverflowUint(uint64(tok.Int)) {
+			return fmt.Errorf("integer %d overflows %s", tok.Int, v.Type())
+		}
+		v.SetUint(uint64(tok.Int))
+	default:
+		return typeError(tok, v)
+	}
+	return nil
+}
+
+func setString(tok Token, v reflect.Value) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(tok.Bytes))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(tok.Bytes)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(tok.Bytes) != v.Len() {
+			return fmt.Errorf("string of length %d doesn't fit %s", len(tok.Bytes), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(tok.Bytes))
+	default:
+		return typeError(tok, v)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeList(tok Token, v reflect.Value) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return typeError(tok, v)
+	}
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			if v.Kind() == reflect.Array && i != v.Len() {
+				return fmt.Errorf("list of length %d doesn't fit %s", i, v.Type())
+			}
+			_, err = d.Token()
+			return err
+		}
+
+		if v.Kind() == reflect.Array {
+			if i >= v.Len() {
+				return fmt.Errorf("list is longer than %s", v.Type())
+			}
+			if err = d.value(v.Index(i)); err != nil {
+				return fmt.Errorf("failed to decode item #%d: %w", i, err)
+			}
+			continue
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err = d.value(elem); err != nil {
+			return fmt.Errorf("failed to decode item #%d: %w", i, err)
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+}
+
+func (d *Decoder) decodeDict(tok Token, v reflect.Value) error {
+	var fields *structFields
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return typeError(tok, v)
+	}
+
+	for {
+		keyTok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if keyTok.Kind == End {
+			return nil
+		}
+		key := string(keyTok.Bytes)
+
+		if fields == nil {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(elem); err != nil {
+				return fmt.Errorf("failed to decode %q: %w", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		i, ok := fields.byKey[key]
+		if !ok {
+			if err = d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = d.value(v.FieldByIndex(fields.list[i].index)); err != nil {
+			return fmt.Errorf("failed to decode %q: %w", key, err)
+		}
+	}
+}
+
+// generic returns the value that starts with the token as int64, string, []interface{} or map[string]interface{}.
+func (d *Decoder) generic(tok Token) (interface{}, error) {
+	switch tok.Kind {
+	case Int:
+		return tok.Int, nil
+	case String:
+		return string(tok.Bytes), nil
+	case List:
+		list := make([]interface{}, 0)
+		for {
+			itemTok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			if itemTok.Kind == End {
+				return list, nil
+			}
+			item, err := d.generic(itemTok)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	default:
+		dict := make(map[string]interface{})
+		for {
+			keyTok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			if keyTok.Kind == End {
+				return dict, nil
+			}
+			valueTok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.generic(valueTok)
+			if err != nil {
+				return nil, err
+			}
+			dict[string(keyTok.Bytes)] = value
+		}
+	}
+}
+
+// skip reads the next value without decoding it.
+func (d *Decoder) skip() error {
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.Kind {
+		case List, Dict:
+			depth++
+		case End:
+			depth--
+		}
+		if depth <= 0 {
+			if depth < 0 {
+				return &SyntaxError{Offset: tok.Offset, msg: "end instead of a value"}
+			}
+			return nil
+		}
+	}
+}
+
+// capture reads the next value and returns its exact bytes.
+func (d *Decoder) capture() ([]byte, error) {
+	d.recording, d.raw = true, nil
+	err := d.skip()
+	raw := d.raw
+	d.recording, d.raw = false, nil
+	return raw, err
+}
+
+// valueDone marks a value of the enclosing dictionary as read, the next token is a key.
+func (d *Decoder) valueDone() {
+	if len(d.stack) > 0 && d.stack[len(d.stack)-1].dict {
+		d.stack[len(d.stack)-1].key = true
+	}
+}
+
+// readInt reads the digits of an integer up to its end.
+func (d *Decoder) readInt() (int64, error) {
+	offset := d.offset
+	digits, err := d.readUntil('e', maxIntDigits)
+	if err != nil {
+		return 0, err
+	}
+	if len(digits) == 0 || !isNumber(digits) {
+		return 0, &SyntaxError{Offset: offset, msg: fmt.Sprintf("malformed integer %q", digits)}
+	}
+	if d.strict && (bytes.HasPrefix(digits, []byte("-0")) || (len(digits) > 1 && digits[0] == '0')) {
+		return 0, &SyntaxError{Offset: offset, msg: fmt.Sprintf("integer %q is not canonical", digits)}
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, &SyntaxError{Offset: offset, msg: fmt.Sprintf("integer %q is out of range", digits)}
+	}
+	return n, nil
+}
+
+// readString reads the length, whose first digit is read already, and the content of a string.
+func (d *Decoder) readString(first byte) ([]byte, error) {
+	offset := d.offset - 1
+	digits, err := d.readUntil(':', maxIntDigits)
+	if err != nil {
+		return nil, err
+	}
+	digits = append([]byte{first}, digits...)
+	if !isNumber(digits) || digits[0] == '-' {
+		return nil, &SyntaxError{Offset: offset, msg: fmt.Sprintf("malformed string length %q", digits)}
+	}
+	if d.strict && len(digits) > 1 && digits[0] == '0' {
+		return nil, &SyntaxError{Offset: offset, msg: fmt.Sprintf("string length %q is not canonical", digits)}
+	}
+	length, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return nil, &SyntaxError{Offset: offset, msg: fmt.Sprintf("string length %q is out of range", digits)}
+	}
+
+	capacity := length
+	if capacity > stringChunk {
+		capacity = stringChunk
+	}
+	buf := make([]byte, 0, capacity)
+	for len(buf) < length {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		end := cap(buf)
+		if end > length {
+			end = length
+		}
+		n, err := d.read(buf[len(buf):end])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// readUntil returns the bytes before the delimiter, the delimiter is consumed.
+func (d *Decoder) readUntil(delim byte, limit int) ([]byte, error) {
+	buf := make([]byte, 0, limit)
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if c == delim {
+			return buf, nil
+		}
+		if len(buf) == limit {
+			return nil, &SyntaxError{Offset: d.offset, msg: fmt.Sprintf("%q is missing", delim)}
+		}
+		buf = append(buf, c)
+	}
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	if d.peeked {
+		return d.peek, nil
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.peeked, d.peek = true, c
+	return c, nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c := d.peek
+	if d.peeked {
+		d.peeked = false
+	} else {
+		var err error
+		if c, err = d.r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	d.offset++
+	if d.recording {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+// read fills p with the following bytes, it is never called with a peeked byte pending.
+func (d *Decoder) read(p []byte) (int, error) {
+	n, err := io.ReadFull(d.r, p)
+	d.offset += int64(n)
+	if d.recording {
+		d.raw = append(d.raw, p[:n]...)
+	}
+	return n, err
+}
+
+func isNumber(digits []byte) bool {
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func typeError(tok Token, v reflect.Value) error {
+	kinds := map[TokenKind]string{Int: "integer", String: "string", List: "list", Dict: "dictionary"}
+	return fmt.Errorf("cannot decode %s into %s", kinds[tok.Kind], v.Type())
+}
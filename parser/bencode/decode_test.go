@@ -0,0 +1,174 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type decodeTarget struct {
+	Name   string     `bencode:"name"`
+	Count  uint8      `bencode:"count,omitempty"`
+	Hash   [4]byte    `bencode:"hash,omitempty"`
+	Tags   []string   `bencode:"tags,omitempty"`
+	Raw    RawMessage `bencode:"raw,omitempty"`
+	Nested *struct {
+		Value int64 `bencode:"value"`
+	} `bencode:"nested,omitempty"`
+	Skipped string `bencode:"-"`
+	Plain   string
+}
+
+func TestDecoderToken(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d1:ai-3e1:bl0:ee"))
+	want := []Token{
+		{Kind: Dict},
+		{Kind: String, Bytes: []byte("a"), Offset: 1},
+		{Kind: Int, Int: -3, Offset: 4},
+		{Kind: String, Bytes: []byte("b"), Offset: 8},
+		{Kind: List, Offset: 11},
+		{Kind: String, Bytes: []byte{}, Offset: 12},
+		{Kind: End, Offset: 14},
+		{Kind: End, Offset: 15},
+	}
+	for i, tt := range want {
+		got, err := d.Token()
+		if err != nil {
+			t.Fatalf("Token() #%d error = %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tt) {
+			t.Errorf("Token() #%d got = %+v, want %+v", i, got, tt)
+		}
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Errorf("Token() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    decodeTarget
+		wantErr bool
+	}{
+		{
+			name: "all fields",
+			data: "d5:Plain1:p5:counti7e4:hash4:abcd7:Skipped1:s4:name1:n6:nestedd5:valuei-1ee3:rawd1:xli1eee4:tagsl1:a1:bee",
+			want: decodeTarget{
+				Name:  "n",
+				Count: 7,
+				Hash:  [4]byte{'a', 'b', 'c', 'd'},
+				Tags:  []string{"a", "b"},
+				Raw:   RawMessage("d1:xli1eee"),
+				Nested: &struct {
+					Value int64 `bencode:"value"`
+				}{Value: -1},
+				Plain: "p",
+			},
+		},
+		{
+			name: "unknown keys are skipped",
+			data: "d7:unknownld1:ai1eee4:name1:ne",
+			want: decodeTarget{Name: "n"},
+		},
+		{
+			name: "unsorted keys and leading zeros",
+			data: "d4:name02:ab5:counti007ee",
+			want: decodeTarget{Name: "ab", Count: 7},
+		},
+		{name: "overflow", data: "d5:counti256ee", wantErr: true},
+		{name: "negative into unsigned", data: "d5:counti-1ee", wantErr: true},
+		{name: "wrong array length", data: "d4:hash3:abce", wantErr: true},
+		{name: "wrong type", data: "d4:namei1ee", wantErr: true},
+		{name: "key is not a string", data: "di1e1:ae", wantErr: true},
+		{name: "key without value", data: "d4:namee", wantErr: true},
+		{name: "unterminated", data: "d4:name1:n", wantErr: true},
+		{name: "string exceeds data", data: "d4:name9:ne", wantErr: true},
+		{name: "malformed integer", data: "d5:counti1-ee", wantErr: true},
+		{name: "empty integer", data: "d5:countiee", wantErr: true},
+		{name: "data after the value", data: "de1:a", wantErr: true},
+		{name: "not a dictionary", data: "le", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeTarget{}
+			err := Decode([]byte(tt.data), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeGeneric(t *testing.T) {
+	var got interface{}
+	if err := Decode([]byte("d1:ali1e0:le1:xdee1:bi-2ee"), &got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"a": []interface{}{int64(1), "", []interface{}{}, "x", map[string]interface{}{}},
+		"b": int64(-2),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() got = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unsorted keys", data: "d1:bi1e1:ai2ee"},
+		{name: "duplicate keys", data: "d1:ai1e1:ai2ee"},
+		{name: "integer with a leading zero", data: "i03e"},
+		{name: "negative zero", data: "i-0e"},
+		{name: "string length with a leading zero", data: "01:a"},
+		{name: "nested unsorted keys", data: "ld1:bi1e1:ai2eee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := Decode([]byte(tt.data), &value); err != nil {
+				t.Fatalf("Decode() error = %v, want lenient decoding", err)
+			}
+
+			d := NewDecoder(strings.NewReader(tt.data))
+			d.Strict()
+			var syntaxErr *SyntaxError
+			if err := d.Decode(&value); !errors.As(err, &syntaxErr) {
+				t.Errorf("Decode() error = %v, want a syntax error", err)
+			}
+		})
+	}
+
+	d := NewDecoder(strings.NewReader("d1:ai0e1:bi-1e1:cl0:4:spamee"))
+	d.Strict()
+	var value interface{}
+	if err := d.Decode(&value); err != nil {
+		t.Errorf("Decode() error = %v, want canonical data to decode", err)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e4:spamd1:ai2eeXYZ"))
+	var first, second interface{}
+	var third map[string]int
+	for _, v := range []interface{}{&first, &second, &third} {
+		if err := d.Decode(v); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+	}
+	if first != int64(1) || second != "spam" || third["a"] != 2 {
+		t.Errorf("Decode() got = %v, %v, %v, want 1, spam, map[a:2]", first, second, third)
+	}
+	if got := d.Offset(); got != 17 {
+		t.Errorf("Offset() got = %d, want 17", got)
+	}
+}
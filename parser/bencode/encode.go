@@ -0,0 +1,226 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Encoder writes bencoded values to a stream.
+	Encoder struct {
+		w io.Writer
+	}
+
+	// field is a struct field encoded under a dictionary key.
+	field struct {
+		key       string
+		index     []int
+		omitEmpty bool
+	}
+
+	// structFields are the fields of a struct type sorted by key.
+	structFields struct {
+		list  []field
+		byKey map[string]int
+	}
+)
+
+var fieldCache sync.Map // reflect.Type -> *structFields
+
+// Encode returns the canonical bencoded representation of v.
+// Integer types encode as integers, strings, byte slices and byte arrays as strings, slices and arrays as lists,
+// maps with string keys and structs as dictionaries with sorted keys. Nil pointers and interfaces in dictionaries
+// are left out. Struct fields are encoded under the key of their bencode tag, `bencode:"key,omitempty"` leaves out
+// empty values and `bencode:"-"` skips the field, untagged exported fields use the field name.
+func Encode(v interface{}) ([]byte, error) {
+	return appendValue(nil, reflect.ValueOf(v))
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the canonical bencoded representation of v, see Encode.
+func (e *Encoder) Encode(v interface{}) error {
+	buf, err := Encode(v)
+	if err != nil {
+		return err
+	}
+	if _, err = e.w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+func appendValue(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return nil, fmt.Errorf("cannot encode nil")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return nil, fmt.Errorf("cannot encode an empty RawMessage")
+		}
+		return append(buf, v.Bytes()...), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, fmt.Errorf("cannot encode nil %s", v.Type())
+		}
+		return appendValue(buf, v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = strconv.AppendInt(append(buf, 'i'), v.Int(), 10)
+		return append(buf, 'e'), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf = strconv.AppendUint(append(buf, 'i'), v.Uint(), 10)
+		return append(buf, 'e'), nil
+	case reflect.String:
+		return appendString(buf, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(buf, v), nil
+		}
+		buf = append(buf, 'l')
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = appendValue(buf, v.Index(i)); err != nil {
+				return nil, fmt.Errorf("failed to encode item #%d: %w", i, err)
+			}
+		}
+		return append(buf, 'e'), nil
+	case reflect.Map:
+		return appendMap(buf, v)
+	case reflect.Struct:
+		return appendStruct(buf, v)
+	default:
+		return nil, fmt.Errorf("cannot encode %s", v.Type())
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	return append(append(buf, ':'), s...)
+}
+
+func appendBytes(buf []byte, v reflect.Value) []byte {
+	buf = strconv.AppendInt(buf, int64(v.Len()), 10)
+	buf = append(buf, ':')
+	if v.Kind() == reflect.Slice {
+		return append(buf, v.Bytes()...)
+	}
+	for i := 0; i < v.Len(); i++ {
+		buf = append(buf, byte(v.Index(i).Uint()))
+	}
+	return buf
+}
+
+func appendMap(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("cannot encode %s, keys must be strings", v.Type())
+	}
+
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	buf = append(buf, 'd')
+	for _, key := range keys {
+		value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if isNil(value) {
+			continue
+		}
+		var err error
+		if buf, err = appendValue(appendString(buf, key), value); err != nil {
+			return nil, fmt.Errorf("failed to encode %q: %w", key, err)
+		}
+	}
+	return append(buf, 'e'), nil
+}
+
+func appendStruct(buf []byte, v reflect.Value) ([]byte, error) {
+	buf = append(buf, 'd')
+	for _, f := range cachedFields(v.Type()).list {
+		value := v.FieldByIndex(f.index)
+		if isNil(value) || (f.omitEmpty && isEmpty(value)) {
+			continue
+		}
+		var err error
+		if buf, err = appendValue(appendString(buf, f.key), value); err != nil {
+			return nil, fmt.Errorf("failed to encode %q: %w", f.key, err)
+		}
+	}
+	return append(buf, 'e'), nil
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	default:
+		return false
+	}
+}
+
+// cachedFields returns the encoded fields of the struct type, the first field wins a key used twice.
+func cachedFields(t reflect.Type) *structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(*structFields)
+	}
+
+	fields := &structFields{byKey: make(map[string]int)}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.IndexByte(tag, ','); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if _, ok := fields.byKey[name]; ok {
+			continue
+		}
+		fields.byKey[name] = len(fields.list)
+		fields.list = append(fields.list, field{key: name, index: sf.Index, omitEmpty: options == "omitempty"})
+	}
+
+	sort.Slice(fields.list, func(i, j int) bool {
+		return fields.list[i].key < fields.list[j].key
+	})
+	for i, f := range fields.list {
+		fields.byKey[f.key] = i
+	}
+
+	actual, _ := fieldCache.LoadOrStore(t, fields)
+	return actual.(*structFields)
+}
@@ -0,0 +1,74 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{name: "integers", value: []interface{}{0, int8(-5), uint16(65535), int64(-1 << 63)}, want: "li0ei-5ei65535ei-9223372036854775808ee"},
+		{name: "strings", value: []interface{}{"", "spam", []byte{0, 1}, [2]byte{'a', 'b'}}, want: "l0:4:spam2:\x00\x012:abe"},
+		{
+			name:  "map keys are sorted",
+			value: map[string]interface{}{"b": 1, "a": map[string]string{"z": "", "y": "x"}, "nil": nil, "": "empty"},
+			want:  "d0:5:empty1:ad1:y1:x1:z0:e1:bi1ee",
+		},
+		{
+			name:  "struct fields are sorted and tagged",
+			value: decodeTarget{Name: "n", Tags: []string{"a"}, Raw: RawMessage("i1e"), Skipped: "s", Plain: "p"},
+			want:  "d5:Plain1:p4:hash4:\x00\x00\x00\x004:name1:n3:rawi1e4:tagsl1:aee",
+		},
+		{name: "empty list", value: []int(nil), want: "le"},
+		{name: "pointer", value: &struct{ A int }{A: 1}, want: "d1:Ai1ee"},
+		{name: "float", value: 1.5, wantErr: true},
+		{name: "bool", value: true, wantErr: true},
+		{name: "nil", value: nil, wantErr: true},
+		{name: "nil in a list", value: []interface{}{nil}, wantErr: true},
+		{name: "integer keys", value: map[int]string{1: "a"}, wantErr: true},
+		{name: "empty raw message", value: RawMessage{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Encode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("Encode() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeIsCanonical(t *testing.T) {
+	values := []interface{}{
+		map[string]interface{}{"z": []interface{}{int64(0), "x"}, "a": map[string]interface{}{"c": int64(-10), "b": ""}},
+		decodeTarget{Name: "n", Count: 3, Hash: [4]byte{1}, Tags: []string{"b", "a"}},
+	}
+	for _, value := range values {
+		data, err := Encode(value)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+
+		d := NewDecoder(bytes.NewReader(data))
+		d.Strict()
+		var decoded interface{}
+		if err = d.Decode(&decoded); err != nil {
+			t.Fatalf("Decode() of %q error = %v", data, err)
+		}
+		again, err := Encode(decoded)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Errorf("Encode() of the decoded value got = %q, want %q", again, data)
+		}
+	}
+}
@@ -2,24 +2,39 @@ package bencode
 
 type (
 	bitTorrent struct {
-		Announce     string     `bencode:"announce"`
-		AnnounceList [][]string `bencode:"announce-list"`
-		Comment      string     `bencode:"comment"`
-		CreatedBy    string     `bencode:"created by"`
-		CreationDate int64      `bencode:"creation date"`
-		Encoding     string     `bencode:"encoding"`
-		Info         info       `bencode:"info"`
+		Announce     string     `bencode:"announce,omitempty"`
+		AnnounceList [][]string `bencode:"announce-list,omitempty"`
+		Comment      string     `bencode:"comment,omitempty"`
+		CreatedBy    string     `bencode:"created by,omitempty"`
+		CreationDate int64      `bencode:"creation date,omitempty"`
+		Encoding     string     `bencode:"encoding,omitempty"`
+		Info         RawMessage `bencode:"info"`
 	}
 
 	info struct {
-		Pieces      string `bencode:"pieces"`
+		Pieces      []byte `bencode:"pieces"` // decoded in place, it takes 20 bytes for every piece
 		PieceLength int64  `bencode:"piece length"`
-		Length      int64  `bencode:"length"`
+		Length      int64  `bencode:"length,omitempty"`
 		Name        string `bencode:"name"`
+		Files       []file `bencode:"files,omitempty"`
+		Private     int64  `bencode:"private,omitempty"`
+		Source      string `bencode:"source,omitempty"`
+	}
+
+	file struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
 	}
 
 	trackerResponse struct {
-		Interval int64  `bencode:"interval"`
-		Peers    string `bencode:"peers"`
+		FailureReason  string
+		WarningMessage string
+		Interval       int64
+		MinInterval    int64
+		TrackerID      string
+		Complete       int64
+		Incomplete     int64
+		Peers          interface{} // compact string or list of peer dictionaries
+		Peers6         string
 	}
 )
@@ -0,0 +1,9 @@
+package bencode
+
+import "reflect"
+
+// RawMessage is the exact bencoded bytes of a value. Decoding into it captures the span of the value,
+// e.g. to hash the info dictionary as it was received, and encoding writes it unchanged.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
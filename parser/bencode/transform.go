@@ -1,28 +1,41 @@
 package bencode
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/genvmoroz/simple-torrent-client/model"
-	"github.com/jackpal/bencode-go"
 )
 
-const (
-	hashLen  = 20 // Length of SHA-1 hash
-	peerSize = 6  // 4 for IP, 2 for port
-)
+const hashLen = 20 // Length of SHA-1 hash
 
-func toDomainBitTorrent(torrent bitTorrent) (model.TorrentInfo, error) {
-	pieceHashes, err := splitPieceHashes(torrent.Info.Pieces)
+func toDomainBitTorrent(torrent bitTorrent, i info) (model.TorrentInfo, error) {
+	pieceHashes, err := splitPieceHashes(i.Pieces)
 	if err != nil {
 		return model.TorrentInfo{}, fmt.Errorf("failed to split piece hashes: %w", err)
 	}
 
-	infoHash, err := infoHash(torrent.Info)
+	if err = validatePath([]string{i.Name}); err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("invalid name: %w", err)
+	}
+	if i.PieceLength <= 0 {
+		return model.TorrentInfo{}, fmt.Errorf("invalid piece length %d", i.PieceLength)
+	}
+
+	files, length, err := toDomainFiles(i)
+	if err != nil {
+		return model.TorrentInfo{}, fmt.Errorf("failed to read files: %w", err)
+	}
+	if numPieces := length/i.PieceLength + (length%i.PieceLength+i.PieceLength-1)/i.PieceLength; int64(len(pieceHashes)) != numPieces {
+		return model.TorrentInfo{}, fmt.Errorf("expected %d piece hashes for length %d, got %d", numPieces, length, len(pieceHashes))
+	}
+
+	rawInfo := make([]byte, len(torrent.Info))
+	copy(rawInfo, torrent.Info)
 
 	return model.TorrentInfo{
 		Announce:     torrent.Announce,
@@ -31,27 +44,229 @@ func toDomainBitTorrent(torrent bitTorrent) (model.TorrentInfo, error) {
 		CreatedBy:    torrent.CreatedBy,
 		CreationDate: time.Unix(torrent.CreationDate, 0),
 		Encoding:     torrent.Encoding,
-		InfoHash:     infoHash,
+		InfoHash:     sha1.Sum(rawInfo),
 		PieceHashes:  pieceHashes,
-		PieceLength:  torrent.Info.PieceLength,
-		Length:       torrent.Info.Length,
-		Name:         torrent.Info.Name,
+		PieceLength:  i.PieceLength,
+		Length:       length,
+		Name:         i.Name,
+		Files:        files,
+		Private:      i.Private == 1,
+		Source:       i.Source,
+		RawInfo:      rawInfo,
+	}, nil
+}
+
+// fromDomainBitTorrent is the inverse of toDomainBitTorrent, the info dictionary is built from the fields.
+func fromDomainBitTorrent(torrentInfo model.TorrentInfo) (bitTorrent, error) {
+	pieces := make([]byte, 0, len(torrentInfo.PieceHashes)*hashLen)
+	for _, hash := range torrentInfo.PieceHashes {
+		pieces = append(pieces, hash[:]...)
+	}
+
+	i := info{
+		Pieces:      pieces,
+		PieceLength: torrentInfo.PieceLength,
+		Name:        torrentInfo.Name,
+		Source:      torrentInfo.Source,
+	}
+	if len(torrentInfo.Files) == 0 {
+		i.Length = torrentInfo.Length
+	}
+	for _, f := range torrentInfo.Files {
+		i.Files = append(i.Files, file{Length: f.Length, Path: f.Path})
+	}
+	if torrentInfo.Private {
+		i.Private = 1
+	}
+
+	rawInfo, err := Encode(i)
+	if err != nil {
+		return bitTorrent{}, fmt.Errorf("failed to encode info: %w", err)
+	}
+
+	var creationDate int64
+	if !torrentInfo.CreationDate.IsZero() {
+		creationDate = torrentInfo.CreationDate.Unix()
+	}
+	return bitTorrent{
+		Announce:     torrentInfo.Announce,
+		AnnounceList: torrentInfo.AnnounceList,
+		Comment:      torrentInfo.Comment,
+		CreatedBy:    torrentInfo.CreatedBy,
+		CreationDate: creationDate,
+		Encoding:     torrentInfo.Encoding,
+		Info:         rawInfo,
 	}, nil
 }
 
-func toDomainTrackerInfoWithoutPeersInfo(tr trackerResponse) (model.TrackerInfo, error) {
-	peers, err := parsePeers([]byte(tr.Peers))
+// toDomainFiles lays out the files of a multi-file torrent one after another and returns the total length.
+func toDomainFiles(i info) ([]model.FileInfo, int64, error) {
+	if len(i.Files) == 0 {
+		if i.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length")
+		}
+		return nil, i.Length, nil
+	}
+	if i.Length != 0 {
+		return nil, 0, fmt.Errorf("both length and files are set")
+	}
+
+	files := make([]model.FileInfo, len(i.Files))
+	var offset int64
+	for index, f := range i.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length of file #%d", index)
+		}
+		if err := validatePath(f.Path); err != nil {
+			return nil, 0, fmt.Errorf("invalid path of file #%d: %w", index, err)
+		}
+		files[index] = model.FileInfo{
+			Path:   f.Path,
+			Offset: offset,
+			Length: f.Length,
+		}
+		offset += f.Length
+	}
+
+	return files, offset, nil
+}
+
+func validatePath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("path is empty")
+	}
+	for _, component := range path {
+		if component == "" || component == "." || component == ".." || strings.ContainsAny(component, `/\`) {
+			return fmt.Errorf("unsafe path component %q", component)
+		}
+	}
+	return nil
+}
+
+func toTrackerResponse(dict map[string]interface{}) trackerResponse {
+	str := func(key string) string {
+		v, _ := dict[key].(string)
+		return v
+	}
+	num := func(key string) int64 {
+		v, _ := dict[key].(int64)
+		return v
+	}
+
+	return trackerResponse{
+		FailureReason:  str("failure reason"),
+		WarningMessage: str("warning message"),
+		Interval:       num("interval"),
+		MinInterval:    num("min interval"),
+		TrackerID:      str("tracker id"),
+		Complete:       num("complete"),
+		Incomplete:     num("incomplete"),
+		Peers:          dict["peers"],
+		Peers6:         str("peers6"),
+	}
+}
+
+func toDomainTrackerInfo(tr trackerResponse) (model.TrackerInfo, error) {
+	if tr.FailureReason != "" {
+		return model.TrackerInfo{}, &model.TrackerFailure{Reason: tr.FailureReason}
+	}
+
+	var peers []model.PeerInfo
+	var err error
+	switch p := tr.Peers.(type) {
+	case nil:
+		peers = make([]model.PeerInfo, 0)
+	case string:
+		peers, err = ParseCompactPeers([]byte(p), net.IPv4len)
+	case []interface{}:
+		peers, err = parseDictPeers(p)
+	default:
+		err = fmt.Errorf("unexpected type %T", p)
+	}
 	if err != nil {
 		return model.TrackerInfo{}, fmt.Errorf("failed to parse Peers: %w", err)
 	}
 
+	peers6, err := ParseCompactPeers([]byte(tr.Peers6), net.IPv6len)
+	if err != nil {
+		return model.TrackerInfo{}, fmt.Errorf("failed to parse Peers6: %w", err)
+	}
+
 	return model.TrackerInfo{
-		Interval: tr.Interval,
-		Peers:    peers,
+		Interval:       tr.Interval,
+		MinInterval:    tr.MinInterval,
+		TrackerID:      tr.TrackerID,
+		WarningMessage: tr.WarningMessage,
+		Complete:       tr.Complete,
+		Incomplete:     tr.Incomplete,
+		Peers:          append(peers, peers6...),
 	}, nil
 }
 
-func parsePeers(rawPeers []byte) ([]model.PeerInfo, error) {
+func toDomainScrapeInfo(dict map[string]interface{}) (map[[20]byte]model.ScrapeInfo, error) {
+	if reason, _ := dict["failure reason"].(string); reason != "" {
+		return nil, &model.TrackerFailure{Reason: reason}
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("files is missing")
+	}
+
+	infos := make(map[[20]byte]model.ScrapeInfo, len(files))
+	for rawHash, rawFile := range files {
+		var infoHash [20]byte
+		if len(rawHash) != len(infoHash) {
+			return nil, fmt.Errorf("invalid info hash length %d", len(rawHash))
+		}
+		copy(infoHash[:], rawHash)
+
+		file, ok := rawFile.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file of %x is not a dictionary", infoHash)
+		}
+		complete, _ := file["complete"].(int64)
+		downloaded, _ := file["downloaded"].(int64)
+		incomplete, _ := file["incomplete"].(int64)
+		infos[infoHash] = model.ScrapeInfo{Complete: complete, Downloaded: downloaded, Incomplete: incomplete}
+	}
+	return infos, nil
+}
+
+// parseDictPeers parses the non-compact peer list, every peer is a dictionary with ip, port and optional peer id.
+func parseDictPeers(rawPeers []interface{}) ([]model.PeerInfo, error) {
+	peers := make([]model.PeerInfo, 0, len(rawPeers))
+	for index, rawPeer := range rawPeers {
+		dict, ok := rawPeer.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("peer #%d is not a dictionary", index)
+		}
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("peer #%d has invalid port %d", index, port)
+		}
+
+		if host == "" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			// a DNS name is allowed, it is resolved by whoever dials the peer
+			peers = append(peers, model.PeerInfo{Host: host, Port: uint16(port)})
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		peers = append(peers, model.PeerInfo{IP: ip, Port: uint16(port)})
+	}
+	return peers, nil
+}
+
+// ParseCompactPeers parses the compact peer list, every peer is ipLen bytes of IP followed by 2 bytes of port.
+func ParseCompactPeers(rawPeers []byte, ipLen int) ([]model.PeerInfo, error) {
+	peerSize := ipLen + 2
 	numPeers := len(rawPeers) / peerSize
 	if len(rawPeers)%peerSize != 0 {
 		return nil, fmt.Errorf("received malformed peers")
@@ -60,15 +275,14 @@ func parsePeers(rawPeers []byte) ([]model.PeerInfo, error) {
 	peers := make([]model.PeerInfo, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = rawPeers[offset : offset+4]
-		peers[i].Port = binary.BigEndian.Uint16(rawPeers[offset+4 : offset+6])
+		peers[i].IP = net.IP(append([]byte(nil), rawPeers[offset:offset+ipLen]...))
+		peers[i].Port = binary.BigEndian.Uint16(rawPeers[offset+ipLen : offset+peerSize])
 	}
 
 	return peers, nil
 }
 
-func splitPieceHashes(s string) ([][20]byte, error) {
-	buf := []byte(s)
+func splitPieceHashes(buf []byte) ([][20]byte, error) {
 	if len(buf)%hashLen != 0 {
 		return nil, fmt.Errorf("received malformed pieces of length %d", len(buf))
 	}
@@ -82,12 +296,22 @@ func splitPieceHashes(s string) ([][20]byte, error) {
 	return hashes, nil
 }
 
-func infoHash(i info) ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, i)
-	if err != nil {
-		return [20]byte{}, fmt.Errorf("failed to marshal: %w", err)
+// CompactPeers encodes the peers whose IP has ipLen bytes in the compact format, other peers are skipped.
+func CompactPeers(peers []model.PeerInfo, ipLen int) []byte {
+	buf := make([]byte, 0, len(peers)*(ipLen+2))
+	for _, peer := range peers {
+		ip := peer.IP.To16()
+		if ipLen == net.IPv4len {
+			ip = peer.IP.To4()
+		} else if peer.IP.To4() != nil {
+			ip = nil
+		}
+		if ip == nil {
+			continue
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, peer.Port)
+		buf = append(append(buf, ip...), port...)
 	}
-
-	return sha1.Sum(buf.Bytes()), nil
+	return buf
 }
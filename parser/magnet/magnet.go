@@ -0,0 +1,170 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+const (
+	scheme     = "magnet"
+	btihPrefix = "urn:btih:"
+
+	maxSelectOnly = 1 << 16 // the most file indices so may select, far more files than a torrent has
+)
+
+// Parse parses the magnet URI, the info hash may be given either in hex or in base32.
+func Parse(uri string) (model.Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return model.Magnet{}, fmt.Errorf("failed to parse URI: %w", err)
+	}
+	if u.Scheme != scheme {
+		return model.Magnet{}, fmt.Errorf("unexpected scheme: %s", u.Scheme)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return model.Magnet{}, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	magnet := model.Magnet{}
+	var found bool
+	for _, key := range sortedKeys(query) {
+		values := query[key]
+		// parameters may be numbered when repeated, e.g. tr.1, tr.2
+		switch name := strings.SplitN(key, ".", 2)[0]; {
+		case key == "x.pe":
+			magnet.Peers = append(magnet.Peers, values...)
+		case name == "xt":
+			for _, xt := range values {
+				if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+					continue // other hashes like urn:btmh are not supported
+				}
+				if magnet.InfoHash, err = parseInfoHash(xt[len(btihPrefix):]); err != nil {
+					return model.Magnet{}, fmt.Errorf("invalid xt %q: %w", xt, err)
+				}
+				found = true
+			}
+		case name == "dn":
+			magnet.Name = values[0]
+		case name == "tr":
+			magnet.Trackers = append(magnet.Trackers, values...)
+		case name == "ws":
+			magnet.WebSeeds = append(magnet.WebSeeds, values...)
+		case name == "so":
+			for _, so := range values {
+				indices, err := parseSelectOnly(so, maxSelectOnly-len(magnet.SelectOnly))
+				if err != nil {
+					return model.Magnet{}, fmt.Errorf("invalid so %q: %w", so, err)
+				}
+				magnet.SelectOnly = append(magnet.SelectOnly, indices...)
+			}
+		}
+	}
+
+	if !found {
+		return model.Magnet{}, fmt.Errorf("xt with a BitTorrent info hash is missing")
+	}
+	return magnet, nil
+}
+
+// ToTorrentInfo returns the TorrentInfo that knows only what the magnet tells, every tracker gets its own tier.
+func ToTorrentInfo(magnet model.Magnet) model.TorrentInfo {
+	announceList := make([][]string, len(magnet.Trackers))
+	for i, tracker := range magnet.Trackers {
+		announceList[i] = []string{tracker}
+	}
+
+	name := magnet.Name
+	if name == "" {
+		name = hex.EncodeToString(magnet.InfoHash[:])
+	}
+
+	return model.TorrentInfo{
+		AnnounceList: announceList,
+		InfoHash:     magnet.InfoHash,
+		Name:         name,
+	}
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(s) {
+	case 40:
+		decoded, err = hex.DecodeString(s)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("unexpected info hash length %d", len(s))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// parseSelectOnly parses a comma separated list of indices and inclusive ranges, e.g. 0,2,4-6.
+// The list must not select more than limit indices.
+func parseSelectOnly(s string, limit int) ([]int, error) {
+	indices := make([]int, 0)
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid index %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+		if last-first >= limit-len(indices) {
+			return nil, fmt.Errorf("more than %d indices are selected", maxSelectOnly)
+		}
+		for i := first; i <= last; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
+
+// sortedKeys keeps numbered parameters in their order, the order of a map is random.
+// Keys are sorted by name and then by number, so tr.2 comes before tr.10.
+func sortedKeys(query url.Values) []string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		nameI, numI := splitKey(keys[i])
+		nameJ, numJ := splitKey(keys[j])
+		if nameI != nameJ || numI == numJ {
+			return keys[i] < keys[j]
+		}
+		return numI < numJ
+	})
+	return keys
+}
+
+// splitKey splits a numbered key like tr.2 into its name and number, keys without a number get -1.
+func splitKey(key string) (string, int) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 2 {
+		if n, err := strconv.Atoi(parts[1]); err == nil && n >= 0 {
+			return parts[0], n
+		}
+	}
+	return key, -1
+}
@@ -0,0 +1,84 @@
+package magnet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+var infoHash = [20]byte{0xc9, 0xe1, 0x57, 0x63, 0xf7, 0x22, 0xf2, 0x3e, 0x98, 0xa2, 0x9d, 0xec, 0xdf, 0xae, 0x34, 0x1b, 0x98, 0xd5, 0x30, 0x56}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    model.Magnet
+		wantErr bool
+	}{
+		{
+			name: "hex info hash with all parameters",
+			uri: "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&dn=Some+Name" +
+				"&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Ftracker.example.org%2Fannounce" +
+				"&ws=http%3A%2F%2Fseed.example.com%2Ffile&x.pe=10.0.0.1%3A6881&so=0,2,4-6",
+			want: model.Magnet{
+				InfoHash:   infoHash,
+				Name:       "Some Name",
+				Trackers:   []string{"udp://tracker.example.com:80", "http://tracker.example.org/announce"},
+				WebSeeds:   []string{"http://seed.example.com/file"},
+				Peers:      []string{"10.0.0.1:6881"},
+				SelectOnly: []int{0, 2, 4, 5, 6},
+			},
+		},
+		{
+			name: "base32 info hash with numbered trackers",
+			uri:  "magnet:?xt=urn:btih:ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW&tr.10=http%3A%2F%2Fc&tr.2=http%3A%2F%2Fb&tr.1=http%3A%2F%2Fa",
+			want: model.Magnet{
+				InfoHash: infoHash,
+				Trackers: []string{"http://a", "http://b", "http://c"},
+			},
+		},
+		{
+			name:    "missing xt",
+			uri:     "magnet:?dn=name",
+			wantErr: true,
+		},
+		{
+			name:    "wrong scheme",
+			uri:     "http://example.com/?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056",
+			wantErr: true,
+		},
+		{
+			name:    "invalid info hash",
+			uri:     "magnet:?xt=urn:btih:c9e157",
+			wantErr: true,
+		},
+		{
+			name:    "invalid range",
+			uri:     "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&so=5-2",
+			wantErr: true,
+		},
+		{
+			name:    "too many selected files",
+			uri:     "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&so=0-2000000000",
+			wantErr: true,
+		},
+		{
+			name:    "too many selected files in several ranges",
+			uri:     "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&so=0-40000&so=0-40000",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+// FileStorage keeps the torrent data in its files on disk, using the single- or multi-file layout of the torrent.
+// The verified pieces are persisted into a resume file on every Flush and restored on creation.
+type FileStorage struct {
+	dir         string
+	resumePath  string
+	torrentInfo model.TorrentInfo
+	completion  *completion
+
+	mux   sync.Mutex
+	files map[string]*os.File
+}
+
+func NewFileStorage(dir string, torrentInfo model.TorrentInfo) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	s := &FileStorage{
+		dir:         dir,
+		resumePath:  resumePath(dir, torrentInfo),
+		torrentInfo: torrentInfo,
+		completion:  newCompletion(len(torrentInfo.PieceHashes)),
+		files:       make(map[string]*os.File),
+	}
+	if err := s.createEmptyFiles(); err != nil {
+		return nil, err
+	}
+	if err := s.restoreCompletion(); err != nil {
+		log.Printf("failed to resume, all pieces will be downloaded again, torrent name: %s, err: %s", torrentInfo.Name, err.Error())
+	}
+
+	return s, nil
+}
+
+// NewFileStorageFactory returns a Factory that places every torrent into dir.
+func NewFileStorageFactory(dir string) Factory {
+	return func(torrentInfo model.TorrentInfo) (Storage, error) {
+		return NewFileStorage(dir, torrentInfo)
+	}
+}
+
+func (s *FileStorage) WriteBlock(piece int, begin int64, data []byte) error {
+	offset, err := pieceRange(s.torrentInfo, piece, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range mapSegments(s.dir, s.torrentInfo, offset, len(data)) {
+		file, err := s.file(seg.path)
+		if err != nil {
+			return err
+		}
+		if _, err = file.WriteAt(data[seg.dataOffset:seg.dataOffset+seg.length], seg.fileOffset); err != nil {
+			return fmt.Errorf("failed to write %s: %w", seg.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStorage) ReadBlock(piece int, begin int64, length int) ([]byte, error) {
+	offset, err := pieceRange(s.torrentInfo, piece, begin, length)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, length)
+	for _, seg := range mapSegments(s.dir, s.torrentInfo, offset, length) {
+		file, err := s.file(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = file.ReadAt(buf[seg.dataOffset:seg.dataOffset+seg.length], seg.fileOffset); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", seg.path, err)
+		}
+	}
+
+	return buf, nil
+}
+
+func (s *FileStorage) MarkComplete(piece int) error {
+	return s.completion.mark(piece)
+}
+
+func (s *FileStorage) IsComplete(piece int) bool {
+	return s.completion.isComplete(piece)
+}
+
+func (s *FileStorage) Flush() error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if err := s.saveResume(); err != nil {
+		return fmt.Errorf("failed to save resume file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStorage) sync() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for path, file := range s.files {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for path, file := range s.files {
+		if err := file.Close(); err != nil {
+			log.Printf("failed to close file %s: %s", path, err.Error())
+		}
+		delete(s.files, path)
+	}
+	return nil
+}
+
+// createEmptyFiles creates the zero-length files of the torrent, no piece maps to them so they are never written.
+func (s *FileStorage) createEmptyFiles() error {
+	for _, f := range Files(s.torrentInfo) {
+		if f.Length != 0 {
+			continue
+		}
+		path := FilePath(s.dir, s.torrentInfo, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		if err = file.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// file returns the opened file, opening and creating it on first use.
+func (s *FileStorage) file(path string) (*os.File, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if file, ok := s.files[path]; ok {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	s.files[path] = file
+	return file, nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+var multiFileTorrentInfo = model.TorrentInfo{
+	PieceHashes: make([][20]byte, 3),
+	PieceLength: 4,
+	Length:      10,
+	Name:        "root",
+	Files: []model.FileInfo{
+		{Path: []string{"a", "b"}, Offset: 0, Length: 3},
+		{Path: []string{"empty"}, Offset: 3, Length: 0},
+		{Path: []string{"c"}, Offset: 3, Length: 7},
+	},
+}
+
+func TestFileStorageAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, multiFileTorrentInfo)
+	if err != nil {
+		t.Fatalf("NewFileStorage() error = %v", err)
+	}
+
+	for piece, data := range []string{"0123", "4567", "89"} {
+		if err = s.WriteBlock(piece, 0, []byte(data)); err != nil {
+			t.Fatalf("WriteBlock(%d) error = %v", piece, err)
+		}
+	}
+	if err = s.WriteBlock(2, 0, []byte("890")); err == nil {
+		t.Errorf("WriteBlock() past the end of the last piece, want error")
+	}
+
+	got, err := s.ReadBlock(0, 2, 2)
+	if err != nil {
+		t.Fatalf("ReadBlock() error = %v", err)
+	}
+	if !bytes.Equal(got, []byte("23")) {
+		t.Errorf("ReadBlock() got = %q, want %q", got, "23")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(dir, "root", "a", "b"): "012",
+		filepath.Join(dir, "root", "c"):      "3456789",
+		filepath.Join(dir, "root", "empty"):  "",
+	} {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", path, err)
+		}
+		if string(content) != want {
+			t.Errorf("file %s got = %q, want %q", path, content, want)
+		}
+	}
+}
+
+func TestFileStorageResume(t *testing.T) {
+	dir := t.TempDir()
+	torrentInfo := multiFileTorrentInfo
+	torrentInfo.InfoHash = sha1.Sum([]byte("info"))
+	torrentInfo.PieceHashes = [][20]byte{sha1.Sum([]byte("0123")), sha1.Sum([]byte("4567")), sha1.Sum([]byte("89"))}
+
+	s, err := NewFileStorage(dir, torrentInfo)
+	if err != nil {
+		t.Fatalf("NewFileStorage() error = %v", err)
+	}
+	for piece, data := range []string{"0123", "4567"} {
+		if err = s.WriteBlock(piece, 0, []byte(data)); err != nil {
+			t.Fatalf("WriteBlock(%d) error = %v", piece, err)
+		}
+		if err = s.MarkComplete(piece); err != nil {
+			t.Fatalf("MarkComplete(%d) error = %v", piece, err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s, err = NewFileStorage(dir, torrentInfo)
+	if err != nil {
+		t.Fatalf("NewFileStorage() error = %v", err)
+	}
+	for piece, want := range []bool{true, true, false} {
+		if got := s.IsComplete(piece); got != want {
+			t.Errorf("IsComplete(%d) got = %v, want %v", piece, got, want)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// both files change, the pieces are rechecked and only the intact one stays complete
+	if err = ioutil.WriteFile(filepath.Join(dir, "root", "c"), []byte("3xxxx"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "root", "a", "b"), []byte("012"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s, err = NewFileStorage(dir, torrentInfo)
+	if err != nil {
+		t.Fatalf("NewFileStorage() error = %v", err)
+	}
+	for piece, want := range []bool{true, false, false} {
+		if got := s.IsComplete(piece); got != want {
+			t.Errorf("IsComplete(%d) after corruption got = %v, want %v", piece, got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"path/filepath"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+type segment struct {
+	path       string
+	fileOffset int64 // offset within the file
+	dataOffset int   // offset within the block
+	length     int
+}
+
+// Files returns the files of the torrent, single-file torrents are represented by one file named after the torrent.
+func Files(torrentInfo model.TorrentInfo) []model.FileInfo {
+	if len(torrentInfo.Files) == 0 {
+		return []model.FileInfo{{
+			Path:   []string{torrentInfo.Name},
+			Length: torrentInfo.Length,
+		}}
+	}
+	return torrentInfo.Files
+}
+
+// FilePath returns the location of the file on disk, multi-file torrents are placed into a directory named after the torrent.
+func FilePath(dir string, torrentInfo model.TorrentInfo, file model.FileInfo) string {
+	if len(torrentInfo.Files) == 0 {
+		return filepath.Join(dir, filepath.Join(file.Path...))
+	}
+	return filepath.Join(dir, torrentInfo.Name, filepath.Join(file.Path...))
+}
+
+// mapSegments splits the byte range [offset, offset+length) of the torrent data into per-file segments.
+func mapSegments(dir string, torrentInfo model.TorrentInfo, offset int64, length int) []segment {
+	segments := make([]segment, 0, 1)
+	end := offset + int64(length)
+
+	for _, file := range Files(torrentInfo) {
+		fileEnd := file.Offset + file.Length
+		if fileEnd <= offset || file.Offset >= end || file.Length == 0 {
+			continue
+		}
+
+		begin := offset
+		if file.Offset > begin {
+			begin = file.Offset
+		}
+		stop := end
+		if fileEnd < stop {
+			stop = fileEnd
+		}
+
+		segments = append(segments, segment{
+			path:       FilePath(dir, torrentInfo, file),
+			fileOffset: begin - file.Offset,
+			dataOffset: int(begin - offset),
+			length:     int(stop - begin),
+		})
+	}
+
+	return segments
+}
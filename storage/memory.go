@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+// MemoryStorage keeps the whole torrent data in memory, it is meant for tests and small torrents.
+type MemoryStorage struct {
+	torrentInfo model.TorrentInfo
+	completion  *completion
+
+	mux  sync.RWMutex
+	data []byte
+}
+
+func NewMemoryStorage(torrentInfo model.TorrentInfo) *MemoryStorage {
+	return &MemoryStorage{
+		torrentInfo: torrentInfo,
+		completion:  newCompletion(len(torrentInfo.PieceHashes)),
+		data:        make([]byte, torrentInfo.Length),
+	}
+}
+
+// NewMemoryStorageFactory returns a Factory that keeps every torrent in memory.
+func NewMemoryStorageFactory() Factory {
+	return func(torrentInfo model.TorrentInfo) (Storage, error) {
+		return NewMemoryStorage(torrentInfo), nil
+	}
+}
+
+func (s *MemoryStorage) WriteBlock(piece int, begin int64, data []byte) error {
+	offset, err := pieceRange(s.torrentInfo, piece, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	copy(s.data[offset:], data)
+	return nil
+}
+
+func (s *MemoryStorage) ReadBlock(piece int, begin int64, length int) ([]byte, error) {
+	offset, err := pieceRange(s.torrentInfo, piece, begin, length)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	buf := make([]byte, length)
+	copy(buf, s.data[offset:])
+	return buf, nil
+}
+
+func (s *MemoryStorage) MarkComplete(piece int) error {
+	return s.completion.mark(piece)
+}
+
+func (s *MemoryStorage) IsComplete(piece int) bool {
+	return s.completion.isComplete(piece)
+}
+
+func (s *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+type (
+	// resumeData is persisted next to the downloaded files and records the verified pieces.
+	resumeData struct {
+		InfoHash string       `json:"info_hash"`
+		Pieces   []bool       `json:"pieces"`
+		Files    []resumeFile `json:"files"`
+	}
+
+	// resumeFile is the state of a file at the moment the resume data was saved.
+	resumeFile struct {
+		Path    string `json:"path"`
+		Size    int64  `json:"size"`
+		ModTime int64  `json:"mod_time"`
+	}
+)
+
+func resumePath(dir string, torrentInfo model.TorrentInfo) string {
+	return filepath.Join(dir, fmt.Sprintf(".%s.resume", hex.EncodeToString(torrentInfo.InfoHash[:])))
+}
+
+func loadResume(path string) (resumeData, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return resumeData{}, err
+	}
+
+	data := resumeData{}
+	if err = json.Unmarshal(content, &data); err != nil {
+		return resumeData{}, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	return data, nil
+}
+
+// saveResume replaces the resume file atomically so a crash never leaves it half-written.
+func saveResume(path string, data resumeData) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// statFiles returns the current state of every file of the torrent, missing files have zero size.
+func statFiles(dir string, torrentInfo model.TorrentInfo) ([]resumeFile, error) {
+	files := Files(torrentInfo)
+	stats := make([]resumeFile, len(files))
+	for index, file := range files {
+		path := FilePath(dir, torrentInfo, file)
+		stats[index].Path = path
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats[index].Size = info.Size()
+		stats[index].ModTime = info.ModTime().UnixNano()
+	}
+	return stats, nil
+}
+
+// restoreCompletion marks the pieces recorded in the resume file as complete.
+// Pieces are hashed again only when a file they span has changed since the resume file was saved.
+func (s *FileStorage) restoreCompletion() error {
+	data, err := loadResume(s.resumePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load resume file: %w", err)
+	}
+	if data.InfoHash != hex.EncodeToString(s.torrentInfo.InfoHash[:]) || len(data.Pieces) != len(s.torrentInfo.PieceHashes) {
+		return fmt.Errorf("resume file %s belongs to another torrent", s.resumePath)
+	}
+
+	current, err := statFiles(s.dir, s.torrentInfo)
+	if err != nil {
+		return fmt.Errorf("failed to stat files: %w", err)
+	}
+	changed := make(map[string]bool, len(current))
+	for index, file := range current {
+		changed[file.Path] = index >= len(data.Files) || data.Files[index] != file
+	}
+
+	for piece, complete := range data.Pieces {
+		if !complete {
+			continue
+		}
+		if s.pieceChanged(piece, changed) && !s.verifyPiece(piece) {
+			continue
+		}
+		if err = s.completion.mark(piece); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStorage) pieceChanged(piece int, changed map[string]bool) bool {
+	offset := int64(piece) * s.torrentInfo.PieceLength
+	for _, seg := range mapSegments(s.dir, s.torrentInfo, offset, s.pieceLength(piece)) {
+		if changed[seg.path] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FileStorage) verifyPiece(piece int) bool {
+	buf, err := s.ReadBlock(piece, 0, s.pieceLength(piece))
+	if err != nil {
+		return false
+	}
+	hash := sha1.Sum(buf)
+	return bytes.Equal(hash[:], s.torrentInfo.PieceHashes[piece][:])
+}
+
+func (s *FileStorage) pieceLength(piece int) int {
+	offset := int64(piece) * s.torrentInfo.PieceLength
+	length := s.torrentInfo.PieceLength
+	if offset+length > s.torrentInfo.Length {
+		length = s.torrentInfo.Length - offset
+	}
+	return int(length)
+}
+
+func (s *FileStorage) saveResume() error {
+	stats, err := statFiles(s.dir, s.torrentInfo)
+	if err != nil {
+		return fmt.Errorf("failed to stat files: %w", err)
+	}
+	return saveResume(s.resumePath, resumeData{
+		InfoHash: hex.EncodeToString(s.torrentInfo.InfoHash[:]),
+		Pieces:   s.completion.snapshot(),
+		Files:    stats,
+	})
+}
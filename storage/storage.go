@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+// Storage keeps the data of a single torrent, pieces are addressed by index and offset within the piece.
+type Storage interface {
+	WriteBlock(piece int, begin int64, data []byte) error
+	ReadBlock(piece int, begin int64, length int) ([]byte, error)
+	MarkComplete(piece int) error
+	IsComplete(piece int) bool
+	Flush() error
+	Close() error
+}
+
+// Factory creates the storage for a torrent.
+type Factory func(torrentInfo model.TorrentInfo) (Storage, error)
+
+// completion tracks the pieces that were verified and marked complete.
+type completion struct {
+	mux    sync.RWMutex
+	pieces []bool
+}
+
+func newCompletion(numPieces int) *completion {
+	return &completion{pieces: make([]bool, numPieces)}
+}
+
+func (c *completion) mark(piece int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if piece < 0 || piece >= len(c.pieces) {
+		return fmt.Errorf("piece index %d is out of range", piece)
+	}
+	c.pieces[piece] = true
+	return nil
+}
+
+func (c *completion) isComplete(piece int) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	return piece >= 0 && piece < len(c.pieces) && c.pieces[piece]
+}
+
+// pieceRange validates the block bounds and returns its offset within the torrent data.
+func pieceRange(torrentInfo model.TorrentInfo, piece int, begin int64, length int) (int64, error) {
+	if piece < 0 || piece >= len(torrentInfo.PieceHashes) {
+		return 0, fmt.Errorf("piece index %d is out of range", piece)
+	}
+	pieceOffset := int64(piece) * torrentInfo.PieceLength
+	pieceLength := torrentInfo.PieceLength
+	if pieceOffset+pieceLength > torrentInfo.Length {
+		pieceLength = torrentInfo.Length - pieceOffset
+	}
+	if begin < 0 || length < 0 || begin+int64(length) > pieceLength {
+		return 0, fmt.Errorf("block [%d, %d) is out of piece #%d bounds", begin, begin+int64(length), piece)
+	}
+	return pieceOffset + begin, nil
+}
+
+func (c *completion) snapshot() []bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	pieces := make([]bool, len(c.pieces))
+	copy(pieces, c.pieces)
+	return pieces
+}
@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// HTTP tracker protocol, see http://bittorrent.org/beps/bep_0003.html and http://bittorrent.org/beps/bep_0023.html
+type httpHandler struct {
+	registry *Registry
+}
+
+// NewHTTPHandler returns the handler of the HTTP tracker, it serves paths ending with /announce and /scrape.
+func NewHTTPHandler(registry *Registry) http.Handler {
+	return &httpHandler{registry: registry}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp map[string]interface{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		resp = h.announce(r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		resp = h.scrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := bencode.Encode(resp)
+	if err != nil {
+		log.Printf("failed to encode tracker response, err: %s", err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err = w.Write(body); err != nil {
+		log.Printf("failed to write tracker response, err: %s", err.Error())
+	}
+}
+
+// announce answers an announce, failures are reported in the body as clients expect.
+func (h *httpHandler) announce(r *http.Request) map[string]interface{} {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return failure("malformed query")
+	}
+	req, err := parseAnnounce(query, r.RemoteAddr)
+	if err != nil {
+		return failure(err.Error())
+	}
+
+	resp, err := h.registry.Announce(req)
+	if err != nil {
+		return failure(err.Error())
+	}
+
+	dict := map[string]interface{}{
+		"interval":     int64(resp.Interval.Seconds()),
+		"min interval": int64(resp.Interval.Seconds() / 2),
+		"complete":     resp.Complete,
+		"incomplete":   resp.Incomplete,
+	}
+	if query.Get("compact") == "1" {
+		addrs := make([]model.PeerInfo, len(resp.Peers))
+		for i, peer := range resp.Peers {
+			addrs[i] = peer.Addr
+		}
+		dict["peers"] = string(bencode.CompactPeers(addrs, net.IPv4len))
+		if peers6 := bencode.CompactPeers(addrs, net.IPv6len); len(peers6) > 0 {
+			dict["peers6"] = string(peers6)
+		}
+		return dict
+	}
+
+	noPeerID := query.Get("no_peer_id") == "1"
+	peers := make([]interface{}, len(resp.Peers))
+	for i, peer := range resp.Peers {
+		p := map[string]interface{}{
+			"ip":   peer.Addr.IP.String(),
+			"port": int64(peer.Addr.Port),
+		}
+		if !noPeerID {
+			p["peer id"] = string(peer.ID[:])
+		}
+		peers[i] = p
+	}
+	dict["peers"] = peers
+	return dict
+}
+
+// scrape answers a scrape of the info hashes in the query, or of every torrent if there are none.
+func (h *httpHandler) scrape(r *http.Request) map[string]interface{} {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return failure("malformed query")
+	}
+	infoHashes := make([][20]byte, 0, len(query["info_hash"]))
+	for _, raw := range query["info_hash"] {
+		infoHash, err := parseHash(raw, "info_hash")
+		if err != nil {
+			return failure(err.Error())
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	files := make(map[string]interface{})
+	for infoHash, info := range h.registry.Scrape(infoHashes) {
+		files[string(infoHash[:])] = map[string]interface{}{
+			"complete":   info.Complete,
+			"downloaded": info.Downloaded,
+			"incomplete": info.Incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}
+}
+
+// parseAnnounce parses the announce parameters, the peer is reachable at the address the request came from.
+func parseAnnounce(query url.Values, remoteAddr string) (AnnounceRequest, error) {
+	req := AnnounceRequest{NumWant: -1}
+
+	var err error
+	if req.InfoHash, err = parseHash(query.Get("info_hash"), "info_hash"); err != nil {
+		return req, err
+	}
+	if req.PeerID, err = parseHash(query.Get("peer_id"), "peer_id"); err != nil {
+		return req, err
+	}
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, fmt.Errorf("invalid port")
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return req, fmt.Errorf("invalid remote address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return req, fmt.Errorf("invalid remote address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	req.Addr = model.PeerInfo{IP: ip, Port: uint16(port)}
+
+	// the amounts are required, a missing left must not turn a leecher into a seeder
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{{"uploaded", &req.Uploaded}, {"downloaded", &req.Downloaded}, {"left", &req.Left}} {
+		raw := query.Get(param.name)
+		if raw == "" {
+			return req, fmt.Errorf("missing %s", param.name)
+		}
+		if *param.value, err = strconv.ParseInt(raw, 10, 64); err != nil || *param.value < 0 {
+			return req, fmt.Errorf("invalid %s", param.name)
+		}
+	}
+	if raw := query.Get("numwant"); raw != "" {
+		if req.NumWant, err = strconv.Atoi(raw); err != nil {
+			return req, fmt.Errorf("invalid numwant")
+		}
+	}
+
+	switch event := client.Event(query.Get("event")); event {
+	case client.EventNone, client.EventStarted, client.EventCompleted, client.EventStopped:
+		req.Event = event
+	default:
+		return req, fmt.Errorf("invalid event")
+	}
+	return req, nil
+}
+
+func parseHash(raw, name string) ([20]byte, error) {
+	var hash [20]byte
+	if len(raw) != len(hash) {
+		return hash, fmt.Errorf("invalid %s", name)
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+func failure(reason string) map[string]interface{} {
+	return map[string]interface{}{"failure reason": reason}
+}
@@ -0,0 +1,187 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+func announceURL(server *httptest.Server, infoHash [20]byte, peerID byte, query string) string {
+	return fmt.Sprintf("%s/announce?info_hash=%s&peer_id=%s&port=6881&uploaded=0&downloaded=0&%s",
+		server.URL, url.QueryEscape(string(infoHash[:])), url.QueryEscape(string([]byte{peerID, 19: 0})), query)
+}
+
+func get(t *testing.T, rawURL string) model.TrackerInfo {
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	info, err := bencode.ParseTrackerInfo(resp.Body)
+	if err != nil {
+		t.Fatalf("ParseTrackerInfo() error = %v", err)
+	}
+	return info
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	allowed := [20]byte{1}
+	registry := NewRegistry(Config{Interval: time.Minute, Whitelist: [][20]byte{allowed}})
+	server := httptest.NewServer(NewHTTPHandler(registry))
+	defer server.Close()
+
+	localhost := model.PeerInfo{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 6881}
+	tests := []struct {
+		name  string
+		url   string
+		want  model.TrackerInfo
+		isErr bool
+	}{
+		{
+			name: "first peer gets nobody",
+			url:  announceURL(server, allowed, 'a', "compact=1&left=10&event=started"),
+			want: model.TrackerInfo{Interval: 60, MinInterval: 30, Incomplete: 1, Peers: []model.PeerInfo{}},
+		},
+		{
+			name: "compact",
+			url:  announceURL(server, allowed, 'b', "compact=1&left=0"),
+			want: model.TrackerInfo{Interval: 60, MinInterval: 30, Complete: 1, Incomplete: 1, Peers: []model.PeerInfo{localhost}},
+		},
+		{
+			name: "non-compact",
+			url:  announceURL(server, allowed, 'c', "left=5"),
+			want: model.TrackerInfo{Interval: 60, MinInterval: 30, Complete: 1, Incomplete: 2},
+		},
+		{
+			name: "stopped",
+			url:  announceURL(server, allowed, 'c', "compact=1&left=5&event=stopped"),
+			want: model.TrackerInfo{Interval: 60, MinInterval: 30, Complete: 1, Incomplete: 1, Peers: []model.PeerInfo{}},
+		},
+		{
+			name:  "not whitelisted",
+			url:   announceURL(server, [20]byte{2}, 'a', "compact=1&left=0"),
+			isErr: true,
+		},
+		{
+			name:  "missing left",
+			url:   announceURL(server, allowed, 'd', "compact=1"),
+			isErr: true,
+		},
+		{
+			name:  "missing port",
+			url:   server.URL + "/announce?info_hash=" + url.QueryEscape(string(allowed[:])),
+			isErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(tt.url)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			got, err := bencode.ParseTrackerInfo(resp.Body)
+			var failure *model.TrackerFailure
+			if tt.isErr {
+				if !errors.As(err, &failure) {
+					t.Errorf("ParseTrackerInfo() error = %v, want a tracker failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTrackerInfo() error = %v", err)
+			}
+			if tt.name == "non-compact" {
+				// the other two peers share the address, the order is random
+				if len(got.Peers) != 2 || !got.Peers[0].IP.Equal(localhost.IP) {
+					t.Errorf("ParseTrackerInfo() peers got = %v, want two peers at %v", got.Peers, localhost)
+				}
+				got.Peers = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTrackerInfo() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPScrapeAndExpiry(t *testing.T) {
+	registry := NewRegistry(Config{Interval: time.Minute})
+	now := time.Now()
+	registry.now = func() time.Time { return now }
+	server := httptest.NewServer(NewHTTPHandler(registry))
+	defer server.Close()
+
+	first, second := [20]byte{1}, [20]byte{2}
+	get(t, announceURL(server, first, 'a', "compact=1&left=10"))
+	get(t, announceURL(server, first, 'a', "compact=1&left=0&event=completed"))
+	now = now.Add(90 * time.Second)
+	get(t, announceURL(server, first, 'b', "compact=1&left=10"))
+	get(t, announceURL(server, second, 'b', "compact=1&left=10"))
+
+	want := map[[20]byte]model.ScrapeInfo{
+		first:  {Complete: 1, Downloaded: 1, Incomplete: 1},
+		second: {Incomplete: 1},
+	}
+	if got := registry.Scrape(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrape() got = %v, want %v", got, want)
+	}
+
+	// the seeder missed two intervals, the leecher announced since
+	now = now.Add(90 * time.Second)
+	resp, err := http.Get(fmt.Sprintf("%s/scrape?info_hash=%s", server.URL, url.QueryEscape(string(first[:]))))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	value, _, err := bencode.DecodePrefix(readAll(t, resp))
+	if err != nil {
+		t.Fatalf("DecodePrefix() error = %v", err)
+	}
+	files := value.(map[string]interface{})["files"].(map[string]interface{})
+	wantFiles := map[string]interface{}{
+		string(first[:]): map[string]interface{}{"complete": int64(0), "downloaded": int64(1), "incomplete": int64(1)},
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("scrape files got = %v, want %v", files, wantFiles)
+	}
+}
+
+func TestHTTPTrackerWithClient(t *testing.T) {
+	registry := NewRegistry(Config{})
+	server := httptest.NewServer(NewHTTPHandler(registry))
+	defer server.Close()
+
+	torrentInfo := model.TorrentInfo{Announce: server.URL + "/announce", InfoHash: [20]byte{3}, Length: 100}
+	for _, peerID := range []byte{'a', 'b'} {
+		info, err := client.GetTrackerInfo(context.Background(), torrentInfo, [20]byte{peerID})
+		if err != nil {
+			t.Fatalf("GetTrackerInfo() error = %v", err)
+		}
+		if want := int64(peerID - 'a'); int64(len(info.Peers)) != want {
+			t.Errorf("GetTrackerInfo() peers got = %v, want %d", info.Peers, want)
+		}
+	}
+}
+
+func readAll(t *testing.T, resp *http.Response) []byte {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return body
+}
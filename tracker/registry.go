@@ -0,0 +1,251 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+const (
+	defaultInterval = 30 * time.Minute
+	defaultNumWant  = 50
+	maxNumWant      = 200
+	expiryIntervals = 2 // peers that missed two announces in a row are dropped
+)
+
+var (
+	// ErrNotAllowed is returned for torrents that aren't on the whitelist.
+	ErrNotAllowed = errors.New("torrent is not allowed on this tracker")
+	// ErrPeerIDInUse is returned when the peer id is announced from another IP than the one of the peer in the swarm.
+	ErrPeerIDInUse = errors.New("peer id is in use by another address")
+)
+
+type (
+	// Config configures the swarm registry, zero fields take the defaults.
+	Config struct {
+		Interval  time.Duration // how often peers are asked to announce, 30 minutes by default
+		Whitelist [][20]byte    // the info hashes the tracker serves, every torrent is served if empty
+	}
+
+	// Registry keeps the swarms of the tracker, it is shared by the HTTP and the UDP endpoints.
+	Registry struct {
+		interval  time.Duration
+		whitelist map[[20]byte]bool
+		now       func() time.Time
+
+		mux    sync.Mutex
+		swarms map[[20]byte]*swarm
+	}
+
+	swarm struct {
+		peers      map[[20]byte]*Peer
+		downloaded int64
+	}
+
+	// Peer is a member of a swarm.
+	Peer struct {
+		ID       [20]byte
+		Addr     model.PeerInfo
+		Left     int64
+		lastSeen time.Time
+	}
+
+	// AnnounceRequest is an announce of a peer, the address is the one the request came from.
+	AnnounceRequest struct {
+		InfoHash   [20]byte
+		PeerID     [20]byte
+		Addr       model.PeerInfo
+		Uploaded   int64
+		Downloaded int64
+		Left       int64
+		Event      client.Event
+		NumWant    int // the number of peers wanted, negative for the default
+	}
+
+	// AnnounceResponse is the answer to an announce.
+	AnnounceResponse struct {
+		Interval   time.Duration
+		Complete   int64 // number of seeders
+		Incomplete int64 // number of leechers
+		Peers      []Peer
+	}
+)
+
+func NewRegistry(cfg Config) *Registry {
+	r := &Registry{
+		interval: cfg.Interval,
+		now:      time.Now,
+		swarms:   make(map[[20]byte]*swarm),
+	}
+	if r.interval <= 0 {
+		r.interval = defaultInterval
+	}
+	if len(cfg.Whitelist) > 0 {
+		r.whitelist = make(map[[20]byte]bool, len(cfg.Whitelist))
+		for _, infoHash := range cfg.Whitelist {
+			r.whitelist[infoHash] = true
+		}
+	}
+	return r
+}
+
+// Interval returns how often peers are asked to announce.
+func (r *Registry) Interval() time.Duration {
+	return r.interval
+}
+
+// Allowed reports whether the tracker serves the torrent.
+func (r *Registry) Allowed(infoHash [20]byte) bool {
+	return r.whitelist == nil || r.whitelist[infoHash]
+}
+
+// Announce records the peer in the swarm of the torrent and returns other peers of the swarm in random order.
+// A stopped peer is removed and gets no peers. The peer id stays bound to the IP of the peer until the peer expires,
+// so nobody else can move or remove it.
+func (r *Registry) Announce(req AnnounceRequest) (AnnounceResponse, error) {
+	if !r.Allowed(req.InfoHash) {
+		return AnnounceResponse{}, ErrNotAllowed
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	now := r.now()
+	s := r.swarms[req.InfoHash]
+	if s == nil {
+		s = &swarm{peers: make(map[[20]byte]*Peer)}
+		r.swarms[req.InfoHash] = s
+	}
+	s.expire(now.Add(-expiryIntervals * r.interval))
+
+	prev, ok := s.peers[req.PeerID]
+	if ok && !prev.Addr.IP.Equal(req.Addr.IP) {
+		return AnnounceResponse{}, ErrPeerIDInUse
+	}
+
+	resp := AnnounceResponse{Interval: r.interval}
+	if req.Event == client.EventStopped {
+		delete(s.peers, req.PeerID)
+		resp.Complete, resp.Incomplete = s.counts()
+		return resp, nil
+	}
+
+	if req.Event == client.EventCompleted && (!ok || prev.Left > 0) {
+		s.downloaded++
+	}
+	s.peers[req.PeerID] = &Peer{ID: req.PeerID, Addr: req.Addr, Left: req.Left, lastSeen: now}
+
+	resp.Complete, resp.Incomplete = s.counts()
+	resp.Peers = s.sample(req.PeerID, numWant(req.NumWant), req.Left == 0)
+	return resp, nil
+}
+
+// Scrape returns the state of the torrents, every torrent is returned if none is given.
+// Torrents that aren't allowed are left out, allowed ones without peers are reported empty.
+func (r *Registry) Scrape(infoHashes [][20]byte) map[[20]byte]model.ScrapeInfo {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range r.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	expired := r.now().Add(-expiryIntervals * r.interval)
+	files := make(map[[20]byte]model.ScrapeInfo, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if !r.Allowed(infoHash) {
+			continue
+		}
+		info := model.ScrapeInfo{}
+		if s := r.swarms[infoHash]; s != nil {
+			s.expire(expired)
+			info.Complete, info.Incomplete = s.counts()
+			info.Downloaded = s.downloaded
+		}
+		files[infoHash] = info
+	}
+	return files
+}
+
+// Expire drops the peers that stopped announcing and the swarms left empty.
+func (r *Registry) Expire() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	expired := r.now().Add(-expiryIntervals * r.interval)
+	for infoHash, s := range r.swarms {
+		s.expire(expired)
+		if len(s.peers) == 0 && s.downloaded == 0 {
+			delete(r.swarms, infoHash)
+		}
+	}
+}
+
+// Run expires peers every interval until the context is done.
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Expire()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *swarm) expire(before time.Time) {
+	for id, peer := range s.peers {
+		if peer.lastSeen.Before(before) {
+			delete(s.peers, id)
+		}
+	}
+}
+
+func (s *swarm) counts() (complete, incomplete int64) {
+	for _, peer := range s.peers {
+		if peer.Left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// sample returns up to n random peers other than the one with the ID, seeders get no other seeders.
+func (s *swarm) sample(id [20]byte, n int, seeding bool) []Peer {
+	peers := make([]Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if peer.ID != id && !(seeding && peer.Left == 0) {
+			peers = append(peers, *peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+func numWant(n int) int {
+	switch {
+	case n < 0:
+		return defaultNumWant
+	case n > maxNumWant:
+		return maxNumWant
+	default:
+		return n
+	}
+}
@@ -0,0 +1,43 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func TestRegistryPeerIDInUse(t *testing.T) {
+	registry := NewRegistry(Config{Interval: time.Minute})
+	now := time.Now()
+	registry.now = func() time.Time { return now }
+
+	victim := model.PeerInfo{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	attacker := model.PeerInfo{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+	announce := func(addr model.PeerInfo, event client.Event) error {
+		_, err := registry.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{'v'}, Addr: addr, Left: 10, Event: event})
+		return err
+	}
+
+	if err := announce(victim, client.EventStarted); err != nil {
+		t.Fatalf("Announce() error = %v", err)
+	}
+	for _, event := range []client.Event{client.EventNone, client.EventStopped} {
+		if err := announce(attacker, event); !errors.Is(err, ErrPeerIDInUse) {
+			t.Errorf("Announce() from another IP error = %v, want %v", err, ErrPeerIDInUse)
+		}
+	}
+	// the port may change, the IP stays
+	if err := announce(model.PeerInfo{IP: victim.IP, Port: 6882}, client.EventNone); err != nil {
+		t.Errorf("Announce() from another port error = %v", err)
+	}
+
+	// the peer id is free once the peer expired
+	now = now.Add(expiryIntervals*time.Minute + time.Second)
+	if err := announce(attacker, client.EventNone); err != nil {
+		t.Errorf("Announce() after expiry error = %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+	"github.com/genvmoroz/simple-torrent-client/parser/bencode"
+)
+
+// UDP tracker protocol, see http://bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDTTL = 2 * time.Minute // clients use a connection ID for a minute, late retries get another one
+	udpMaxPacketSize   = 65507
+	udpMaxScrapeHashes = 74
+	udpMaxBackoff      = time.Second // the longest wait after a failed read
+)
+
+var udpEvents = map[uint32]client.Event{
+	0: client.EventNone,
+	1: client.EventCompleted,
+	2: client.EventStarted,
+	3: client.EventStopped,
+}
+
+// UDPServer answers UDP tracker requests from the swarms of a registry. Connection IDs are signed with a secret
+// instead of being stored: they carry the time they were issued and an HMAC of it and the client address.
+type UDPServer struct {
+	registry *Registry
+	secret   []byte
+	now      func() time.Time
+}
+
+func NewUDPServer(registry *Registry) (*UDPServer, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return &UDPServer{registry: registry, secret: secret, now: time.Now}, nil
+}
+
+// Serve answers the requests that arrive on the connection until it is closed, it backs off while reading fails.
+func (s *UDPServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, udpMaxPacketSize)
+	var backoff time.Duration
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > udpMaxBackoff {
+				backoff = udpMaxBackoff
+			}
+			log.Printf("failed to read udp tracker request, retrying in %s, err: %s", backoff, err.Error())
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		resp := s.handle(buf[:n], udpAddr)
+		if resp == nil {
+			continue
+		}
+		if _, err = conn.WriteTo(resp, addr); err != nil {
+			log.Printf("failed to answer udp tracker request, addr: %s, err: %s", addr, err.Error())
+		}
+	}
+}
+
+// handle returns the response to the packet, nil if the packet is not worth an answer.
+func (s *UDPServer) handle(req []byte, addr *net.UDPAddr) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	txID := binary.BigEndian.Uint32(req[12:16])
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], udpActionConnect)
+		binary.BigEndian.PutUint32(resp[4:8], txID)
+		binary.BigEndian.PutUint64(resp[8:16], s.connectionID(addr.IP, s.now()))
+		return resp
+	}
+
+	if !s.validConnectionID(connectionID, addr.IP) {
+		return udpError(txID, "invalid connection id")
+	}
+	switch action {
+	case udpActionAnnounce:
+		return s.announce(req, txID, addr)
+	case udpActionScrape:
+		return s.scrape(req, txID)
+	default:
+		return udpError(txID, "unknown action")
+	}
+}
+
+func (s *UDPServer) announce(req []byte, txID uint32, addr *net.UDPAddr) []byte {
+	if len(req) < 98 {
+		return udpError(txID, "announce request is too short")
+	}
+	event, ok := udpEvents[binary.BigEndian.Uint32(req[80:84])]
+	if !ok {
+		return udpError(txID, "invalid event")
+	}
+
+	ip, ipLen := addr.IP, net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, ipLen = ip4, net.IPv4len
+	}
+	announce := AnnounceRequest{
+		Addr:       model.PeerInfo{IP: ip, Port: binary.BigEndian.Uint16(req[96:98])},
+		Downloaded: int64(binary.BigEndian.Uint64(req[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(req[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(req[72:80])),
+		Event:      event,
+		NumWant:    int(int32(binary.BigEndian.Uint32(req[92:96]))),
+	}
+	copy(announce.InfoHash[:], req[16:36])
+	copy(announce.PeerID[:], req[36:56])
+
+	resp, err := s.registry.Announce(announce)
+	if err != nil {
+		return udpError(txID, err.Error())
+	}
+
+	// the peers are of the address family the request came over
+	addrs := make([]model.PeerInfo, len(resp.Peers))
+	for i, peer := range resp.Peers {
+		addrs[i] = peer.Addr
+	}
+	peers := bencode.CompactPeers(addrs, ipLen)
+
+	buf := make([]byte, 20, 20+len(peers))
+	binary.BigEndian.PutUint32(buf[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(resp.Interval.Seconds()))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(resp.Incomplete))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(resp.Complete))
+	return append(buf, peers...)
+}
+
+func (s *UDPServer) scrape(req []byte, txID uint32) []byte {
+	hashes := req[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrapeHashes {
+		return udpError(txID, "invalid scrape request")
+	}
+
+	infoHashes := make([][20]byte, len(hashes)/20)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], hashes[20*i:])
+	}
+	files := s.registry.Scrape(infoHashes)
+
+	// every info hash gets an entry, torrents that aren't allowed are reported empty
+	buf := make([]byte, 8+12*len(infoHashes))
+	binary.BigEndian.PutUint32(buf[0:4], udpActionScrape)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+	for i, infoHash := range infoHashes {
+		info := files[infoHash]
+		offset := 8 + 12*i
+		binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(info.Complete))
+		binary.BigEndian.PutUint32(buf[offset+4:offset+8], uint32(info.Downloaded))
+		binary.BigEndian.PutUint32(buf[offset+8:offset+12], uint32(info.Incomplete))
+	}
+	return buf
+}
+
+// connectionID returns the ID for the address issued at the time: the time in seconds followed by the signature.
+func (s *UDPServer) connectionID(ip net.IP, issued time.Time) uint64 {
+	ts := uint32(issued.Unix())
+	return uint64(ts)<<32 | uint64(s.sign(ip, ts))
+}
+
+// validConnectionID reports whether the ID was issued to the address and didn't expire.
+func (s *UDPServer) validConnectionID(id uint64, ip net.IP) bool {
+	ts := uint32(id >> 32)
+	age := s.now().Sub(time.Unix(int64(ts), 0))
+	if age < 0 || age > udpConnectionIDTTL {
+		return false
+	}
+	return hmac.Equal(uint32Bytes(uint32(id)), uint32Bytes(s.sign(ip, ts)))
+}
+
+func (s *UDPServer) sign(ip net.IP, ts uint32) uint32 {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	mac.Write(uint32Bytes(ts))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return buf
+}
+
+func udpError(txID uint32, message string) []byte {
+	buf := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(buf[0:4], udpActionError)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+	return append(buf, message...)
+}
@@ -0,0 +1,155 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genvmoroz/simple-torrent-client/client"
+	"github.com/genvmoroz/simple-torrent-client/model"
+)
+
+func serveUDP(t *testing.T, network, addr string, registry *Registry) (*UDPServer, net.PacketConn) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("ListenPacket() error = %v", err)
+	}
+	server, err := NewUDPServer(registry)
+	if err != nil {
+		t.Fatalf("NewUDPServer() error = %v", err)
+	}
+	go func() { _ = server.Serve(conn) }()
+	t.Cleanup(func() { _ = conn.Close() })
+	return server, conn
+}
+
+func TestUDPTrackerWithClient(t *testing.T) {
+	for _, network := range []struct {
+		name string
+		addr string
+		ip   net.IP
+	}{
+		{name: "ipv4", addr: "127.0.0.1:0", ip: net.IPv4(127, 0, 0, 1).To4()},
+		{name: "ipv6", addr: "[::1]:0", ip: net.IPv6loopback},
+	} {
+		t.Run(network.name, func(t *testing.T) {
+			registry := NewRegistry(Config{})
+			_, conn := serveUDP(t, "udp", network.addr, registry)
+
+			torrentInfo := model.TorrentInfo{Announce: "udp://" + conn.LocalAddr().String(), InfoHash: [20]byte{3}, Length: 100}
+			for _, peerID := range []byte{'a', 'b'} {
+				info, err := client.GetTrackerInfo(context.Background(), torrentInfo, [20]byte{peerID})
+				if err != nil {
+					t.Fatalf("GetTrackerInfo() error = %v", err)
+				}
+				if peerID == 'a' {
+					continue
+				}
+				want := []model.PeerInfo{{IP: network.ip, Port: client.DefaultPort}}
+				if len(info.Peers) != 1 || !info.Peers[0].IP.Equal(want[0].IP) || info.Peers[0].Port != want[0].Port {
+					t.Errorf("GetTrackerInfo() peers got = %v, want %v", info.Peers, want)
+				}
+				if info.Incomplete != 2 {
+					t.Errorf("GetTrackerInfo() incomplete got = %d, want 2", info.Incomplete)
+				}
+			}
+
+			files, err := client.Scrape(context.Background(), torrentInfo.Announce, [][20]byte{torrentInfo.InfoHash})
+			if err != nil {
+				t.Fatalf("Scrape() error = %v", err)
+			}
+			if want := map[[20]byte]model.ScrapeInfo{torrentInfo.InfoHash: {Incomplete: 2}}; !reflect.DeepEqual(files, want) {
+				t.Errorf("Scrape() got = %v, want %v", files, want)
+			}
+		})
+	}
+}
+
+func TestUDPServerHandle(t *testing.T) {
+	allowed := [20]byte{1}
+	registry := NewRegistry(Config{Whitelist: [][20]byte{allowed}})
+	server, err := NewUDPServer(registry)
+	if err != nil {
+		t.Fatalf("NewUDPServer() error = %v", err)
+	}
+	now := time.Now()
+	server.now = func() time.Time { return now }
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	connectionID := server.connectionID(addr.IP, now)
+	if _, err = registry.Announce(AnnounceRequest{InfoHash: allowed, PeerID: [20]byte{'a'}, Event: client.EventCompleted}); err != nil {
+		t.Fatalf("Announce() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  []byte
+		addr *net.UDPAddr
+		age  time.Duration
+		want []byte
+	}{
+		{
+			name: "connect with a wrong protocol id",
+			req:  packet(1, udpActionConnect, 7),
+			addr: addr,
+		},
+		{
+			name: "scrape",
+			req:  append(append(packet(connectionID, udpActionScrape, 7), allowed[:]...), make([]byte, 20)...),
+			addr: addr,
+			want: []byte{0, 0, 0, 2, 0, 0, 0, 7, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "scrape without info hashes",
+			req:  packet(connectionID, udpActionScrape, 7),
+			addr: addr,
+			want: append([]byte{0, 0, 0, 3, 0, 0, 0, 7}, "invalid scrape request"...),
+		},
+		{
+			name: "expired connection id",
+			req:  append(packet(connectionID, udpActionScrape, 7), allowed[:]...),
+			addr: addr,
+			age:  udpConnectionIDTTL + time.Second,
+			want: append([]byte{0, 0, 0, 3, 0, 0, 0, 7}, "invalid connection id"...),
+		},
+		{
+			name: "connection id of another address",
+			req:  append(packet(connectionID, udpActionScrape, 7), allowed[:]...),
+			addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881},
+			want: append([]byte{0, 0, 0, 3, 0, 0, 0, 7}, "invalid connection id"...),
+		},
+		{
+			name: "announce of a torrent that isn't allowed",
+			req:  announcePacket(connectionID, [20]byte{2}),
+			addr: addr,
+			want: append([]byte{0, 0, 0, 3, 0, 0, 0, 7}, ErrNotAllowed.Error()...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.now = func() time.Time { return now.Add(tt.age) }
+			if got := server.handle(tt.req, tt.addr); !bytes.Equal(got, tt.want) {
+				t.Errorf("handle() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func packet(connectionID uint64, action, txID uint32) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], connectionID)
+	binary.BigEndian.PutUint32(buf[8:12], action)
+	binary.BigEndian.PutUint32(buf[12:16], txID)
+	return buf
+}
+
+func announcePacket(connectionID uint64, infoHash [20]byte) []byte {
+	buf := append(packet(connectionID, udpActionAnnounce, 7), make([]byte, 82)...)
+	copy(buf[16:36], infoHash[:])
+	binary.BigEndian.PutUint16(buf[96:98], 6881)
+	return buf
+}